@@ -0,0 +1,267 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+
+	"github.com/phnaharris/harris-blockchain-token/storage"
+	"github.com/phnaharris/harris-blockchain-token/wallet"
+)
+
+// The address index keeps, for every public key hash, the transactions of the
+// active chain paying or spending from it and the outpoints it can spend. It
+// is optional: it is kept only while the addrIndexFlag key exists.
+//
+//	addrtx-<pubkeyhash><height><position>  -> AddressTxRef
+//	addrout-<pubkeyhash><txid><out>        -> empty, the entry is in the UTXO set
+var (
+	addrTxPrefix  = []byte("addrtx-")
+	addrOutPrefix = []byte("addrout-")
+	addrIndexFlag = []byte("addrindex")
+)
+
+var ErrNoAddrIndex = errors.New("address index is not enabled")
+
+// AddressTxRef is a transaction of the active chain touching an address, with
+// what it pays to and spends from the address.
+type AddressTxRef struct {
+	TxID      []byte
+	BlockHash []byte
+	Height    int
+	Position  int // index in the block transactions
+	Received  int
+	Sent      int
+}
+
+func addrTxKey(pubKeyHash []byte, height, position int) []byte {
+	key := make([]byte, len(addrTxPrefix)+len(pubKeyHash)+8)
+	copy(key, addrTxPrefix)
+	copy(key[len(addrTxPrefix):], pubKeyHash)
+	binary.BigEndian.PutUint32(key[len(key)-8:], uint32(height))
+	binary.BigEndian.PutUint32(key[len(key)-4:], uint32(position))
+
+	return key
+}
+
+func addrOutKey(pubKeyHash, txID []byte, out int) []byte {
+	key := append(append([]byte{}, addrOutPrefix...), pubKeyHash...)
+	return append(key, utxoKey(txID, out)[len(utxoPrefix):]...)
+}
+
+func (ref AddressTxRef) Serialize() ([]byte, error) {
+	var buffer bytes.Buffer
+	encode := gob.NewEncoder(&buffer)
+	err := encode.Encode(ref)
+	return buffer.Bytes(), err
+}
+
+func DeserializeAddressTxRef(data []byte) (AddressTxRef, error) {
+	var ref AddressTxRef
+	decode := gob.NewDecoder(bytes.NewReader(data))
+	err := decode.Decode(&ref)
+	return ref, err
+}
+
+func (chain *Blockchain) AddrIndexEnabled() (bool, error) {
+	_, err := chain.Database.Get(addrIndexFlag)
+	if err == storage.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// spentOutputs returns the outputs spent by the inputs of a block in block
+// order, from its undo data.
+func (chain *Blockchain) spentOutputs(block *Block) ([]TxOutput, error) {
+	undo, err := chain.GetBlockUndo(block.Hash)
+	if err != nil {
+		return nil, err
+	}
+
+	var spent []TxOutput
+	for _, entry := range undo.SpentOutputs {
+		spent = append(spent, entry.Output())
+	}
+
+	return spent, nil
+}
+
+func (chain *Blockchain) indexAddresses(batch storage.Batch, block *Block, spent []TxOutput) error {
+	spentIdx := 0
+
+	for position, tx := range block.Transaction {
+		refs := make(map[string]*AddressTxRef)
+		ref := func(pubKeyHash []byte) *AddressTxRef {
+			if refs[string(pubKeyHash)] == nil {
+				refs[string(pubKeyHash)] = &AddressTxRef{TxID: tx.ID, BlockHash: block.Hash, Height: block.Height, Position: position}
+			}
+			return refs[string(pubKeyHash)]
+		}
+
+		if !tx.IsCoinbase() {
+			for _, in := range tx.Inputs {
+				pubKeyHash := wallet.PublicKeyHash(in.PubKey)
+				ref(pubKeyHash).Sent += spent[spentIdx].Value
+				spentIdx++
+
+				if err := batch.Delete(addrOutKey(pubKeyHash, in.ID, in.Out)); err != nil {
+					return err
+				}
+			}
+		}
+
+		for outIdx, out := range tx.Outputs {
+			ref(out.PubKeyHash).Received += out.Value
+
+			if err := batch.Put(addrOutKey(out.PubKeyHash, tx.ID, outIdx), []byte{}); err != nil {
+				return err
+			}
+		}
+
+		for pubKeyHash, ref := range refs {
+			value, err := ref.Serialize()
+			if err != nil {
+				return err
+			}
+			if err := batch.Put(addrTxKey([]byte(pubKeyHash), block.Height, position), value); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (chain *Blockchain) unindexAddresses(batch storage.Batch, block *Block) error {
+	for position := len(block.Transaction) - 1; position >= 0; position-- {
+		tx := block.Transaction[position]
+
+		for outIdx, out := range tx.Outputs {
+			if err := batch.Delete(addrOutKey(out.PubKeyHash, tx.ID, outIdx)); err != nil {
+				return err
+			}
+			if err := batch.Delete(addrTxKey(out.PubKeyHash, block.Height, position)); err != nil {
+				return err
+			}
+		}
+
+		if tx.IsCoinbase() {
+			continue
+		}
+
+		for _, in := range tx.Inputs {
+			pubKeyHash := wallet.PublicKeyHash(in.PubKey)
+			if err := batch.Put(addrOutKey(pubKeyHash, in.ID, in.Out), []byte{}); err != nil {
+				return err
+			}
+			if err := batch.Delete(addrTxKey(pubKeyHash, block.Height, position)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// GetAddressHistory returns the transactions of the active chain touching
+// pubKeyHash, oldest first. It needs the address index.
+func (chain *Blockchain) GetAddressHistory(pubKeyHash []byte) ([]AddressTxRef, error) {
+	enabled, err := chain.AddrIndexEnabled()
+	if err != nil {
+		return nil, err
+	}
+	if !enabled {
+		return nil, ErrNoAddrIndex
+	}
+
+	var refs []AddressTxRef
+	var decodeErr error
+	prefix := append(append([]byte{}, addrTxPrefix...), pubKeyHash...)
+
+	err = chain.Database.Iterate(prefix, nil, func(_, value []byte) bool {
+		ref, err := DeserializeAddressTxRef(value)
+		if err != nil {
+			decodeErr = err
+			return false
+		}
+		refs = append(refs, ref)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return refs, decodeErr
+}
+
+// addressOutpoints lists the UTXO set keys of the outputs of pubKeyHash from
+// the address index.
+func (chain *Blockchain) addressOutpoints(pubKeyHash []byte) ([][]byte, error) {
+	var outpoints [][]byte
+	prefix := append(append([]byte{}, addrOutPrefix...), pubKeyHash...)
+
+	err := chain.Database.Iterate(prefix, nil, func(key, _ []byte) bool {
+		outpoints = append(outpoints, append(append([]byte{}, utxoPrefix...), key[len(prefix):]...))
+		return true
+	})
+
+	return outpoints, err
+}
+
+// ReindexAddresses rebuilds the address index from the active chain and
+// enables it. It returns the number of indexed transactions.
+func (chain *Blockchain) ReindexAddresses() (int, error) {
+	if err := chain.DropAddrIndex(); err != nil {
+		return 0, err
+	}
+
+	bestHeight, err := chain.GetBestHeight()
+	if err != nil {
+		return 0, err
+	}
+	hashes, err := chain.GetBlockHashesRange(0, bestHeight)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, hash := range hashes {
+		block, err := chain.GetBlock(hash)
+		if err != nil {
+			return count, err
+		}
+
+		spent, err := chain.spentOutputs(&block)
+		if err != nil {
+			return count, err
+		}
+		err = chain.Database.Update(func(batch storage.Batch) error {
+			return chain.indexAddresses(batch, &block, spent)
+		})
+		if err != nil {
+			return count, err
+		}
+		count += len(block.Transaction)
+	}
+
+	return count, chain.Database.Put(addrIndexFlag, []byte{1})
+}
+
+// DropAddrIndex disables the address index and deletes it.
+func (chain *Blockchain) DropAddrIndex() error {
+	if err := chain.Database.Delete(addrIndexFlag); err != nil {
+		return err
+	}
+
+	UTXOSet := UTXOSet{chain}
+	if err := UTXOSet.DeleteByPrefix(addrTxPrefix); err != nil {
+		return err
+	}
+	return UTXOSet.DeleteByPrefix(addrOutPrefix)
+}
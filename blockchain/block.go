@@ -1,19 +1,17 @@
 package blockchain
 
 import (
-	"bytes"
-	"encoding/gob"
 	"fmt"
 	"time"
+
+	"github.com/phnaharris/harris-blockchain-token/chaincfg"
 )
 
 type Block struct {
-	Timestamp   int64
+	BlockHeader
 	Hash        []byte
 	Transaction []*Transaction
-	PrevHash    []byte
-	Nonce       int
-	Height      int
+	Seal        []byte // set by the consensus engine, not covered by the hash
 }
 
 func (b *Block) HashTransaction() []byte {
@@ -22,46 +20,100 @@ func (b *Block) HashTransaction() []byte {
 	for _, tx := range b.Transaction {
 		txHashes = append(txHashes, tx.Serialize())
 	}
-	tree := NewMerkleTree(txHashes)
+	tree, err := NewMerkleTree(txHashes)
+	if err != nil {
+		// a block without transactions has no merkle root
+		return nil
+	}
 
 	return tree.RootNode.Data
 }
 
-func CreateBlock(txs []*Transaction, prevHash []byte, height int) *Block {
-	block := &Block{time.Now().Unix(), []byte{}, txs, prevHash, 0, height}
-	pow := NewProof(block)
-	nonce, hash := pow.Run()
-	fmt.Printf("Nonce: %d.\n", nonce)
-	block.Hash = hash
-	block.Nonce = nonce
-	fmt.Printf("POW: %x.\n", hash)
-	fmt.Printf("Block created! Block hash: %x.\n", block.Hash)
+// NewBlock returns a block that still has to be mined.
+func NewBlock(txs []*Transaction, prevHash []byte, height int, bits uint32) *Block {
+	header := BlockHeader{BlockVersion, prevHash, nil, time.Now().Unix(), bits, 0, height}
+	block := &Block{header, []byte{}, txs, nil}
+	block.MerkleRoot = block.HashTransaction()
 
 	return block
 }
 
-func Genesis(coinbase *Transaction) *Block {
-	return CreateBlock([]*Transaction{coinbase}, []byte{}, 0)
+// GenesisBlock builds the first block of the network of params.
+func GenesisBlock(params *chaincfg.Params) *Block {
+	g := params.Genesis
+
+	txIn := TxInput{[]byte{}, -1, nil, []byte(g.CoinbaseData)}
+	txOut := TxOutput{params.Subsidy.BlockSubsidy(0), g.PubKeyHash}
+	coinbase := &Transaction{nil, []TxInput{txIn}, []TxOutput{txOut}}
+	coinbase.ID = coinbase.Hash()
+
+	block := NewBlock([]*Transaction{coinbase}, []byte{}, 0, g.Bits)
+	block.Timestamp = g.Timestamp
+	block.Nonce = g.Nonce
+	block.Hash = block.BlockHeader.Hash()
+
+	return block
 }
 
+// Serialize encodes the block as its encoding version, the 88 byte header,
+// the number of transactions, every transaction as length prefixed bytes and
+// the seal, if there is one, as length prefixed bytes.
 func (b *Block) Serialize() []byte {
-	var res bytes.Buffer
+	e := &encoder{}
+	e.buffer.WriteByte(EncodingVersion)
+	e.buffer.Write(b.BlockHeader.Serialize())
+	e.writeUvarint(uint64(len(b.Transaction)))
+	for _, tx := range b.Transaction {
+		e.writeBytes(tx.Serialize())
+	}
+	if len(b.Seal) > 0 {
+		e.writeBytes(b.Seal)
+	}
 
-	encoder := gob.NewEncoder(&res)
-	err := encoder.Encode(b)
+	return e.buffer.Bytes()
+}
 
-	Handle(err)
+func DeserializeBlock(data []byte) (*Block, error) {
+	d := &decoder{data: data}
+	if version := d.readByte(); d.err == nil && version != EncodingVersion {
+		d.fail(fmt.Errorf("%w: %d", ErrBadEncodingVersion, version))
+	}
 
-	return res.Bytes()
-}
+	header, err := DeserializeBlockHeader(d.readFixed(HeaderLength))
+	if d.err == nil && err != nil {
+		d.fail(err)
+	}
 
-func DeserializeBlock(data []byte) *Block {
-	var block Block
+	block := &Block{}
+	if header != nil {
+		block.BlockHeader = *header
+		block.Hash = header.Hash()
+	}
 
-	decoder := gob.NewDecoder(bytes.NewReader(data))
-	err := decoder.Decode(&block)
+	for i, n := 0, d.readCount(1); i < n; i++ {
+		txData := d.readBytes()
+		if d.err != nil {
+			break
+		}
+		tx, err := DeserializeTransaction(txData)
+		if err != nil {
+			d.fail(err)
+			break
+		}
+		block.Transaction = append(block.Transaction, &tx)
+	}
+
+	// an empty seal is left out, not encoded
+	if d.err == nil && len(d.data) > 0 {
+		block.Seal = d.readBytes()
+		if d.err == nil && len(block.Seal) == 0 {
+			d.fail(ErrNonCanonical)
+		}
+	}
 
-	Handle(err)
+	if err := d.finish(); err != nil {
+		return nil, err
+	}
 
-	return &block
+	return block, nil
 }
@@ -2,31 +2,38 @@ package blockchain
 
 import (
 	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"encoding/hex"
 	"errors"
 	"fmt"
-	"log"
 	"os"
-	"runtime"
+	"sync"
+	"sync/atomic"
 
-	"github.com/dgraph-io/badger"
+	"github.com/phnaharris/harris-blockchain-token/chaincfg"
+	"github.com/phnaharris/harris-blockchain-token/storage"
 )
 
-const (
-	dbPath      = "./tmp/blocks_%s"
-	genesisData = "First Transaction from Genesis"
+const dbPath = "%s/blocks_%s"
+
+var (
+	ErrWrongGenesis     = errors.New("genesis block is not the one of the network")
+	ErrNoBlockchain     = errors.New("no existing blockchain found, please create one")
+	ErrBlockchainExists = errors.New("blockchain already exists")
+	ErrBlockNotFound    = errors.New("block is not found")
 )
 
+// Blockchain is the chain of blocks of a node. Its methods may be called from
+// several goroutines: the tip is read atomically and readers of more than one
+// key of the active chain, like GetBlockHashes, see it between two changes.
 type Blockchain struct {
-	LastHash []byte
-	Database *badger.DB
-}
+	Database storage.KV
+	Params   *chaincfg.Params
+	Engine   Engine
 
-func Handle(err error) {
-	if err != nil {
-		log.Panic(err)
-	}
+	lastHash atomic.Value // []byte, hash of the tip
+	mu       sync.RWMutex // held to change the active chain
 }
 
 func DBExist(path string) bool {
@@ -37,212 +44,315 @@ func DBExist(path string) bool {
 	return true
 }
 
-func ContinueBlockchain(nodeID string) *Blockchain {
-	path := fmt.Sprintf(dbPath, nodeID)
+func ContinueBlockchain(nodeID string, params *chaincfg.Params, engine Engine) (*Blockchain, error) {
+	path := fmt.Sprintf(dbPath, params.DataDir, nodeID)
 	if !DBExist(path) {
-		fmt.Println("No existing blockchain found! Please create one!")
-		runtime.Goexit()
+		return nil, fmt.Errorf("%w: %s", ErrNoBlockchain, path)
+	}
+
+	db, err := storage.OpenBadger(path)
+	if err != nil {
+		return nil, err
+	}
+
+	chain, err := LoadBlockchain(db, params, engine)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
 	}
 
-	var lastHash []byte
+	return chain, nil
+}
 
-	opts := badger.DefaultOptions(path)
-	db, err := openDB(path, opts)
-	Handle(err)
+// LoadBlockchain returns the chain kept in db, which InitBlockchain or
+// NewBlockchain created.
+func LoadBlockchain(db storage.KV, params *chaincfg.Params, engine Engine) (*Blockchain, error) {
+	lastHash, err := db.Get([]byte("lh"))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the tip: %w", err)
+	}
 
-	err = db.View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte("lh"))
-		Handle(err)
-		lastHash, err = item.ValueCopy(nil)
-		return err
-	})
-	Handle(err)
+	chain := &Blockchain{Database: db, Params: params, Engine: engine}
+	chain.lastHash.Store(lastHash)
 
-	chain := &Blockchain{lastHash, db}
-	return chain
+	// a database of another network or from before the fixed genesis blocks
+	genesisHash, err := hex.DecodeString(params.Genesis.Hash)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := chain.GetBlock(genesisHash); err != nil {
+		return nil, fmt.Errorf("%w: no block %x", ErrWrongGenesis, genesisHash)
+	}
+
+	if err := chain.checkChainState(); err != nil {
+		return nil, err
+	}
+	if err := chain.checkHeightIndex(); err != nil {
+		return nil, err
+	}
+
+	return chain, nil
 }
 
-func InitBlockchain(address, nodeId string) *Blockchain {
+// InitBlockchain creates the database of a node with the genesis block of the
+// network.
+func InitBlockchain(nodeId string, params *chaincfg.Params, engine Engine) (*Blockchain, error) {
 	// check if another blockchain exist
-	path := fmt.Sprintf(dbPath, nodeId)
+	path := fmt.Sprintf(dbPath, params.DataDir, nodeId)
 	if DBExist(path) {
-		fmt.Println("Blockchain already exist!")
-		runtime.Goexit()
+		return nil, fmt.Errorf("%w: %s", ErrBlockchainExists, path)
 	}
 
-	// create a new database
-	var lastHash []byte
-	opts := badger.DefaultOptions(path)
-	db, err := openDB(path, opts)
-	Handle(err)
+	// create a new database, the data directory of the network may not
+	// exist yet
+	if err := os.MkdirAll(params.DataDir, 0755); err != nil {
+		return nil, err
+	}
+	db, err := storage.OpenBadger(path)
+	if err != nil {
+		return nil, err
+	}
 
-	err = db.Update(func(txn *badger.Txn) error {
-		// mine a genesis block
-		cbtx := CoinbaseTx(address, genesisData)
-		// fmt.Printf("\n%x\n", cbtx.ID)
-		genesis := Genesis(cbtx)
-		fmt.Println("Genesis block created!")
-		fmt.Printf("%x\n", genesis.Hash)
+	chain, err := NewBlockchain(db, params, engine)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
 
-		err = txn.Set(genesis.Hash, genesis.Serialize())
-		Handle(err)
-		err = txn.Set([]byte("lh"), genesis.Hash)
-		lastHash = genesis.Hash
+	return chain, nil
+}
 
-		return err
-	})
+// NewBlockchain creates a chain in the empty store db with the genesis block
+// of the network, a storage.Memory keeps it off the disk.
+func NewBlockchain(db storage.KV, params *chaincfg.Params, engine Engine) (*Blockchain, error) {
+	genesis := GenesisBlock(params)
+	if hex.EncodeToString(genesis.Hash) != params.Genesis.Hash {
+		return nil, fmt.Errorf("%w: built %x, want %s", ErrWrongGenesis, genesis.Hash, params.Genesis.Hash)
+	}
 
-	Handle(err)
+	chain := &Blockchain{Database: db, Params: params, Engine: engine}
+	if err := chain.connectBlock(genesis); err != nil {
+		return nil, err
+	}
+	fmt.Println("Genesis block created!")
+	fmt.Printf("%x\n", genesis.Hash)
 
-	return &Blockchain{lastHash, db}
+	return chain, nil
 }
 
-func (chain *Blockchain) AddBlock(block *Block) {
-	err := chain.Database.Update(func(txn *badger.Txn) error {
-		// check if block is exist
-		if _, err := txn.Get([]byte(block.Hash)); err == nil {
-			// get block success => block exist
-			return nil
-		}
+// AddBlock stores a block and makes the chain with the most cumulative work
+// the active one, reorganizing if a side chain becomes heavier.
+func (chain *Blockchain) AddBlock(block *Block) (*TipChange, error) {
+	chain.mu.Lock()
+	defer chain.mu.Unlock()
 
-		// add block data to database
-		blockData := block.Serialize()
-		err := txn.Set(block.Hash, blockData)
-		Handle(err)
+	return chain.addBlock(block)
+}
 
-		// get last block in database
-		item, err := txn.Get([]byte("lh"))
-		Handle(err)
+// ConnectBlock validates a block on top of the tip and makes it the new tip,
+// the block and all the changes of the chain state are written in one
+// atomic batch.
+func (chain *Blockchain) ConnectBlock(block *Block) error {
+	chain.mu.Lock()
+	defer chain.mu.Unlock()
 
-		lastHash, err := item.ValueCopy(nil)
-		Handle(err)
+	if !bytes.Equal(block.PrevHash, chain.LastHash()) {
+		return ErrNotOnTip
+	}
+	_, err := chain.addBlock(block)
 
-		item, err = txn.Get([]byte(lastHash))
-		Handle(err)
+	return err
+}
 
-		lastBlockData, err := item.ValueCopy(nil)
-		Handle(err)
+func (chain *Blockchain) addBlock(block *Block) (*TipChange, error) {
+	// check if block is exist
+	if _, err := chain.GetBlock(block.Hash); err == nil {
+		invalid, err := chain.IsInvalid(block.Hash)
+		if err != nil {
+			return nil, err
+		}
+		if invalid {
+			return nil, fmt.Errorf("%w: %x", ErrInvalidBlock, block.Hash)
+		}
+		return &TipChange{}, nil
+	} else if !errors.Is(err, ErrBlockNotFound) {
+		return nil, err
+	}
 
-		lastBlock := DeserializeBlock(lastBlockData)
+	if err := chain.checkBlockSanity(block); err != nil {
+		return nil, err
+	}
 
-		// check if block have the max height
-		if lastBlock.Height < block.Height {
-			// change last hash
-			err = txn.Set([]byte("lh"), block.Hash)
-			Handle(err)
-			chain.LastHash = block.Hash
+	parent, err := chain.GetBlock(block.PrevHash)
+	if errors.Is(err, ErrBlockNotFound) {
+		return nil, ErrOrphanBlock
+	}
+	if err != nil {
+		return nil, err
+	}
+	invalid, err := chain.IsInvalid(parent.Hash)
+	if err != nil {
+		return nil, err
+	}
+	if invalid {
+		return nil, fmt.Errorf("%w: %x", ErrInvalidAncestor, parent.Hash)
+	}
+	if err := chain.checkHeaderContext(&block.BlockHeader, &parent.BlockHeader); err != nil {
+		return nil, err
+	}
+
+	// a block on top of the tip is checked against the UTXO set before it
+	// is stored, side chain blocks are checked when they are connected
+	if bytes.Equal(block.PrevHash, chain.LastHash()) {
+		if err := chain.checkBlockTransactions(block); err != nil {
+			return nil, err
+		}
+		if err := chain.connectBlock(block); err != nil {
+			return nil, err
 		}
+		return &TipChange{Connected: []*Block{block}}, nil
+	}
 
-		return nil
-	})
-	Handle(err)
-}
+	work, err := chain.ChainWork(block.PrevHash)
+	if err != nil {
+		return nil, err
+	}
+	work.Add(work, chain.Engine.Work(&block.BlockHeader))
 
-func (chain *Blockchain) GetBestHeight() int {
-	var lastBlock *Block
-	err := chain.Database.View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte("lh"))
-		Handle(err)
+	err = chain.Database.Update(func(batch storage.Batch) error {
+		if err := batch.Put(block.Hash, block.Serialize()); err != nil {
+			return err
+		}
+		return batch.Put(chainWorkKey(block.Hash), work.Bytes())
+	})
+	if err != nil {
+		return nil, err
+	}
 
-		lastHash, err := item.ValueCopy(nil)
-		Handle(err)
+	tipWork, err := chain.ChainWork(chain.LastHash())
+	if err != nil {
+		return nil, err
+	}
+	if work.Cmp(tipWork) <= 0 {
+		return &TipChange{}, nil
+	}
 
-		item, err = txn.Get(lastHash)
-		Handle(err)
+	return chain.reorganize(block)
+}
 
-		lastBlockData, err := item.ValueCopy(nil)
-		Handle(err)
+// LastHash returns the hash of the tip.
+func (chain *Blockchain) LastHash() []byte {
+	hash, _ := chain.lastHash.Load().([]byte)
+	return hash
+}
 
-		lastBlock = DeserializeBlock(lastBlockData)
+func (chain *Blockchain) GetBestHeight() (int, error) {
+	lastBlock, err := chain.GetBlock(chain.LastHash())
+	if err != nil {
+		return 0, err
+	}
 
-		return nil
-	})
-	Handle(err)
-	return lastBlock.Height
+	return lastBlock.Height, nil
 }
 
 func (chain *Blockchain) GetBlock(blockHash []byte) (Block, error) {
-	var block Block
-
-	err := chain.Database.View(func(txn *badger.Txn) error {
-		if item, err := txn.Get(blockHash); err != nil {
-			return errors.New("block is not found")
-		} else {
-			blockData, _ := item.ValueCopy(nil)
-			block = *DeserializeBlock(blockData)
-		}
+	blockData, err := chain.Database.Get(blockHash)
+	if err == storage.ErrNotFound {
+		return Block{}, fmt.Errorf("%w: %x", ErrBlockNotFound, blockHash)
+	}
+	if err != nil {
+		return Block{}, err
+	}
 
-		return nil
-	})
+	block, err := DeserializeBlock(blockData)
+	if err != nil {
+		return Block{}, fmt.Errorf("block %x: %w", blockHash, err)
+	}
 
-	return block, err
+	return *block, nil
 }
 
-func (chain *Blockchain) GetBlockHashes() [][]byte {
-	var blockHashes [][]byte
+// GetBlockHashes lists the hashes of the active chain from the tip down.
+func (chain *Blockchain) GetBlockHashes() ([][]byte, error) {
+	chain.mu.RLock()
+	defer chain.mu.RUnlock()
 
-	iter := BlockchainIterator{chain.LastHash, chain.Database}
-	blockHashes = append(blockHashes, iter.CurrentHash)
-	for {
-		prevBlock := iter.Next()
-		blockHashes = append(blockHashes, prevBlock.Hash)
-		if len(prevBlock.PrevHash) == 0 {
-			break
-		}
+	bestHeight, err := chain.GetBestHeight()
+	if err != nil {
+		return nil, err
+	}
+	hashes, err := chain.GetBlockHashesRange(0, bestHeight)
+	if err != nil {
+		return nil, err
 	}
 
-	return blockHashes
+	blockHashes := make([][]byte, 0, len(hashes))
+	for i := len(hashes) - 1; i >= 0; i-- {
+		blockHashes = append(blockHashes, hashes[i])
+	}
+
+	return blockHashes, nil
+}
+
+func (chain *Blockchain) MineBlock(transactions []*Transaction) (*Block, error) {
+	return chain.MineBlockContext(context.Background(), transactions)
 }
 
-func (chain *Blockchain) MineBlock(transactions []*Transaction) *Block {
+// MineBlockContext mines transactions on top of the tip, it stops with the
+// context error when ctx is done before a block is found.
+func (chain *Blockchain) MineBlockContext(ctx context.Context, transactions []*Transaction) (*Block, error) {
 	// verify transaction in for loop
 	for _, tx := range transactions {
-		if !chain.VerifyTransaction(tx) {
-			log.Panic("Invalid transaction!")
+		if err := chain.VerifyTransaction(tx); err != nil {
+			return nil, err
 		}
 	}
 
-	// get last block + last height in current blockchain
-	var lastHash []byte = chain.LastHash
-	var lastHeight int
-	err := chain.Database.View(func(txn *badger.Txn) error {
-		item, err := txn.Get(lastHash)
-		Handle(err)
-		lastBlockData, err := item.ValueCopy(nil)
-		lastBlock := DeserializeBlock(lastBlockData)
-		lastHeight = lastBlock.Height
-
-		return err
-	})
-	Handle(err)
+	// get last block in current blockchain
+	lastBlock, err := chain.GetBlock(chain.LastHash())
+	if err != nil {
+		return nil, err
+	}
 
-	// create newBlock with next height and next last hash
-	newBlock := CreateBlock(transactions, lastHash, lastHeight+1)
+	// create newBlock with next height, next last hash and required difficulty
+	bits, err := chain.Engine.CalcDifficulty(chain, &lastBlock.BlockHeader)
+	if err != nil {
+		return nil, err
+	}
+	newBlock := NewBlock(transactions, lastBlock.Hash, lastBlock.Height+1, bits)
+	newBlock.Timestamp, err = chain.nextTimestamp(&lastBlock.BlockHeader)
+	if err != nil {
+		return nil, err
+	}
+	if err := chain.Engine.Seal(ctx, newBlock); err != nil {
+		return nil, err
+	}
 
-	// update newBlock to database
-	err = chain.Database.Update(func(txn *badger.Txn) error {
-		err := txn.Set(newBlock.Hash, newBlock.Serialize())
-		Handle(err)
-		err = txn.Set([]byte("lh"), newBlock.Hash)
-		chain.LastHash = newBlock.Hash
-		return err
-	})
-	Handle(err)
+	// validate newBlock, then add it to database and UTXO set
+	if err := chain.ConnectBlock(newBlock); err != nil {
+		return nil, err
+	}
 
-	return newBlock
+	return newBlock, nil
 }
 
-func (chain *Blockchain) FindUTXO() map[string][]TxOutput {
+func (chain *Blockchain) FindUTXO() (map[string]map[int]UTXOEntry, error) {
 	// find unspend transaction output for all transaction
-	UTXO := make(map[string][]TxOutput)
+	UTXO := make(map[string]map[int]UTXOEntry)
 	spentTXOs := make(map[string][]int)
 
 	iter := chain.Iterator()
 
 	for {
-		currentBlock := iter.Next()
+		currentBlock, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
 
-		for _, tx := range currentBlock.Transaction {
+		// the transactions of a block may spend outputs of the ones before
+		// them, walk them backwards so the spends are known first
+		for i := len(currentBlock.Transaction) - 1; i >= 0; i-- {
+			tx := currentBlock.Transaction[i]
 			txID := hex.EncodeToString(tx.ID)
 
 		Start:
@@ -255,7 +365,10 @@ func (chain *Blockchain) FindUTXO() map[string][]TxOutput {
 						}
 					}
 				}
-				UTXO[txID] = append(UTXO[txID], out)
+				if UTXO[txID] == nil {
+					UTXO[txID] = make(map[int]UTXOEntry)
+				}
+				UTXO[txID][outIdx] = UTXOEntry{out.Value, out.PubKeyHash, currentBlock.Height, tx.IsCoinbase()}
 			}
 
 			if !tx.IsCoinbase() {
@@ -271,59 +384,67 @@ func (chain *Blockchain) FindUTXO() map[string][]TxOutput {
 		}
 	}
 
-	return UTXO
+	return UTXO, nil
 }
 
 func (chain *Blockchain) FindTransaction(ID []byte) (Transaction, error) {
-	iter := chain.Iterator()
-
-	for {
-		currentBlock := iter.Next()
-
-		for _, tx := range currentBlock.Transaction {
-			if bytes.Equal(ID, tx.ID) {
-				return *tx, nil
-			}
-		}
-
-		if len(currentBlock.PrevHash) == 0 {
-			break
-		}
+	tx, _, err := chain.GetTransaction(ID)
+	if err != nil {
+		return Transaction{}, err
 	}
 
-	return Transaction{}, errors.New("transaction does not exist")
+	return *tx, nil
 }
 
-func (chain *Blockchain) SignTransaction(tx *Transaction, privKey ecdsa.PrivateKey) {
+func (chain *Blockchain) SignTransaction(tx *Transaction, privKey ecdsa.PrivateKey) error {
 	prevTxs := make(map[string]Transaction)
 
 	for _, in := range tx.Inputs {
 		prevTx, err := chain.FindTransaction(in.ID)
-		Handle(err)
+		if err != nil {
+			return err
+		}
 		prevTxs[hex.EncodeToString(prevTx.ID)] = prevTx
 	}
 
-	tx.Sign(&privKey, prevTxs)
+	return tx.Sign(&privKey, prevTxs)
 }
 
-func (chain *Blockchain) VerifyTransaction(tx *Transaction) bool {
+// VerifyTransaction checks the signatures of a transaction and that the
+// coinbase outputs it spends are mature.
+func (chain *Blockchain) VerifyTransaction(tx *Transaction) error {
 	// check if transaction is coinbase => true
 	if tx.IsCoinbase() {
-		return true
+		return nil
 	}
 
 	prevTxs := make(map[string]Transaction)
+	UTXOSet := UTXOSet{chain}
+	bestHeight, err := chain.GetBestHeight()
+	if err != nil {
+		return err
+	}
 
 	for _, in := range tx.Inputs {
+		// coinbase outputs must mature before they are spent
+		entry, err := UTXOSet.FindEntry(in.ID, in.Out)
+		if err == nil && !entry.IsMature(bestHeight+1, chain.Params.CoinbaseMaturity) {
+			return fmt.Errorf("%w: %x:%d", ErrImmatureSpend, in.ID, in.Out)
+		}
+		if err != nil && !errors.Is(err, ErrMissingInput) {
+			return err
+		}
+
 		prevTx, err := chain.FindTransaction(in.ID)
-		Handle(err)
+		if err != nil {
+			return err
+		}
 		prevTxs[hex.EncodeToString(prevTx.ID)] = prevTx
 	}
 
-	return tx.Verify(prevTxs)
-}
+	if !tx.Verify(prevTxs) {
+		return fmt.Errorf("%w: tx %x", ErrInvalidSignature, tx.ID)
+	}
 
-func openDB(dir string, opts badger.Options) (*badger.DB, error) {
-	db, err := badger.Open(opts)
-	return db, err
+	return nil
 }
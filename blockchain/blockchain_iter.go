@@ -1,33 +1,32 @@
 package blockchain
 
 import (
-	"github.com/dgraph-io/badger"
+	"fmt"
+
+	"github.com/phnaharris/harris-blockchain-token/storage"
 )
 
 type BlockchainIterator struct {
 	CurrentHash []byte
-	Database    *badger.DB
+	Database    storage.KV
 }
 
 func (chain *Blockchain) Iterator() *BlockchainIterator {
-	i := BlockchainIterator{chain.LastHash, chain.Database}
+	i := BlockchainIterator{chain.LastHash(), chain.Database}
 	return &i
 }
 
-func (iter *BlockchainIterator) Next() *Block {
-	var block *Block
-
-	err := iter.Database.View(func(txn *badger.Txn) error {
-		item, err := txn.Get(iter.CurrentHash)
-		Handle(err)
-
-		blockData, err := item.ValueCopy(nil)
-		block = DeserializeBlock(blockData)
+func (iter *BlockchainIterator) Next() (*Block, error) {
+	blockData, err := iter.Database.Get(iter.CurrentHash)
+	if err != nil {
+		return nil, fmt.Errorf("block %x: %w", iter.CurrentHash, err)
+	}
 
-		return err
-	})
-	Handle(err)
+	block, err := DeserializeBlock(blockData)
+	if err != nil {
+		return nil, fmt.Errorf("block %x: %w", iter.CurrentHash, err)
+	}
 	iter.CurrentHash = block.PrevHash
 
-	return block
+	return block, nil
 }
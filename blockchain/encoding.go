@@ -0,0 +1,196 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Blocks and transactions are stored, hashed and relayed in a canonical
+// binary encoding described in docs/encoding.md. Every encoded block and
+// transaction starts with EncodingVersion.
+const EncodingVersion = 1
+
+var (
+	ErrBadEncodingVersion = errors.New("unknown encoding version")
+	ErrTruncatedData      = errors.New("encoded data is truncated")
+	ErrNonCanonical       = errors.New("encoded data is not canonical")
+)
+
+type encoder struct {
+	buffer bytes.Buffer
+}
+
+func (e *encoder) writeUvarint(v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	e.buffer.Write(buf[:n])
+}
+
+func (e *encoder) writeVarint(v int64) {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(buf[:], v)
+	e.buffer.Write(buf[:n])
+}
+
+func (e *encoder) writeBytes(data []byte) {
+	e.writeUvarint(uint64(len(data)))
+	e.buffer.Write(data)
+}
+
+func (e *encoder) writeInput(in *TxInput) {
+	e.writeBytes(in.ID)
+	e.writeVarint(int64(in.Out))
+	e.writeBytes(in.Signature)
+	e.writeBytes(in.PubKey)
+}
+
+func (e *encoder) writeOutput(out *TxOutput) {
+	e.writeVarint(int64(out.Value))
+	e.writeBytes(out.PubKeyHash)
+}
+
+func (e *encoder) writeTransaction(tx *Transaction) {
+	e.buffer.WriteByte(EncodingVersion)
+	e.writeUvarint(uint64(len(tx.Inputs)))
+	for i := range tx.Inputs {
+		e.writeInput(&tx.Inputs[i])
+	}
+	e.writeUvarint(uint64(len(tx.Outputs)))
+	for i := range tx.Outputs {
+		e.writeOutput(&tx.Outputs[i])
+	}
+}
+
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) fail(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+}
+
+func (d *decoder) readByte() byte {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.data) < 1 {
+		d.fail(ErrTruncatedData)
+		return 0
+	}
+	b := d.data[0]
+	d.data = d.data[1:]
+	return b
+}
+
+func (d *decoder) readUvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.fail(ErrTruncatedData)
+		return 0
+	}
+	var buf [binary.MaxVarintLen64]byte
+	if binary.PutUvarint(buf[:], v) != n {
+		d.fail(ErrNonCanonical)
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *decoder) readVarint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.data)
+	if n <= 0 {
+		d.fail(ErrTruncatedData)
+		return 0
+	}
+	var buf [binary.MaxVarintLen64]byte
+	if binary.PutVarint(buf[:], v) != n {
+		d.fail(ErrNonCanonical)
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *decoder) readFixed(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if len(d.data) < n {
+		d.fail(ErrTruncatedData)
+		return nil
+	}
+	b := append([]byte{}, d.data[:n]...)
+	d.data = d.data[n:]
+	return b
+}
+
+func (d *decoder) readBytes() []byte {
+	length := d.readUvarint()
+	if d.err == nil && length > uint64(len(d.data)) {
+		d.fail(ErrTruncatedData)
+	}
+	return d.readFixed(int(length))
+}
+
+// readCount reads a number of items which take at least minSize bytes each,
+// so a corrupted count cannot make the decoder allocate too much.
+func (d *decoder) readCount(minSize int) int {
+	count := d.readUvarint()
+	if d.err == nil && count > uint64(len(d.data)/minSize) {
+		d.fail(ErrTruncatedData)
+		return 0
+	}
+	return int(count)
+}
+
+func (d *decoder) readInput() TxInput {
+	var in TxInput
+	in.ID = d.readBytes()
+	in.Out = int(d.readVarint())
+	in.Signature = d.readBytes()
+	in.PubKey = d.readBytes()
+	return in
+}
+
+func (d *decoder) readOutput() TxOutput {
+	var out TxOutput
+	out.Value = int(d.readVarint())
+	out.PubKeyHash = d.readBytes()
+	return out
+}
+
+func (d *decoder) readTransaction() *Transaction {
+	if version := d.readByte(); d.err == nil && version != EncodingVersion {
+		d.fail(fmt.Errorf("%w: %d", ErrBadEncodingVersion, version))
+	}
+
+	tx := &Transaction{}
+	// an input is at least 4 bytes, an output at least 2
+	for i, n := 0, d.readCount(4); i < n; i++ {
+		tx.Inputs = append(tx.Inputs, d.readInput())
+	}
+	for i, n := 0, d.readCount(2); i < n; i++ {
+		tx.Outputs = append(tx.Outputs, d.readOutput())
+	}
+	return tx
+}
+
+// finish reports an error if the decoder failed or data is left over.
+func (d *decoder) finish() error {
+	if d.err == nil && len(d.data) > 0 {
+		d.fail(ErrNonCanonical)
+	}
+	return d.err
+}
@@ -0,0 +1,181 @@
+package blockchain_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"github.com/phnaharris/harris-blockchain-token/blockchain"
+)
+
+// The vectors of docs/encoding.md.
+const (
+	outputVector   = "2814000102030405060708090a0b0c0d0e0f10111213"
+	inputVector    = "20aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa0203010203020405"
+	coinbaseVector = "01010001000767656e65736973012814000102030405060708090a0b0c0d0e0f10111213"
+	coinbaseID     = "a8b2c5890c5bc8f5ebef2baf1f4eb9109a2e0cb15b523da9846b5ab99b487b5c"
+	spendVector    = "010120a8b2c5890c5bc8f5ebef2baf1f4eb9109a2e0cb15b523da9846b5ab99b487b5c0003010203020405021e14000102030405060708090a0b0c0d0e0f101112130a14000102030405060708090a0b0c0d0e0f10111213"
+	spendID        = "a0619cf7dc0d5df8575f38a737cd4cc7d9ac9266b7cc3ad2098814a5eec4b48c"
+	headerVector   = "000000010000000000000000000000000000000000000000000000000000000000000000a8b2c5890c5bc8f5ebef2baf1f4eb9109a2e0cb15b523da9846b5ab99b487b5c000000006553f1001f1000000000000700000000"
+	blockVector    = "01" + headerVector + "012401010001000767656e65736973012814000102030405060708090a0b0c0d0e0f10111213"
+	blockHash      = "2cfc26e3aaf5b16cd3ec9922ed472045a32e9b23d535dbb91896fe4940e33bf6"
+)
+
+func vectorPKH() []byte {
+	pkh := make([]byte, 20)
+	for i := range pkh {
+		pkh[i] = byte(i)
+	}
+	return pkh
+}
+
+func vectorCoinbase() *blockchain.Transaction {
+	return &blockchain.Transaction{
+		Inputs:  []blockchain.TxInput{{ID: []byte{}, Out: -1, PubKey: []byte("genesis")}},
+		Outputs: []blockchain.TxOutput{{Value: 20, PubKeyHash: vectorPKH()}},
+	}
+}
+
+func vectorSpend() *blockchain.Transaction {
+	id, _ := hex.DecodeString(coinbaseID)
+	return &blockchain.Transaction{
+		Inputs: []blockchain.TxInput{{ID: id, Out: 0, Signature: []byte{1, 2, 3}, PubKey: []byte{4, 5}}},
+		Outputs: []blockchain.TxOutput{
+			{Value: 15, PubKeyHash: vectorPKH()},
+			{Value: 5, PubKeyHash: vectorPKH()},
+		},
+	}
+}
+
+func vectorBlock() *blockchain.Block {
+	block := &blockchain.Block{
+		BlockHeader: blockchain.BlockHeader{
+			Version:   1,
+			PrevHash:  []byte{},
+			Timestamp: 1700000000,
+			Bits:      0x1f100000,
+			Nonce:     7,
+			Height:    0,
+		},
+		Transaction: []*blockchain.Transaction{vectorCoinbase()},
+	}
+	block.MerkleRoot = block.HashTransaction()
+	block.Hash = block.BlockHeader.Hash()
+
+	return block
+}
+
+func decodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func checkEncoding(t *testing.T, name string, got []byte, want string) {
+	t.Helper()
+
+	if hex.EncodeToString(got) != want {
+		t.Errorf("%s: encoded as %x, want %s", name, got, want)
+	}
+}
+
+func TestEncodingVectors(t *testing.T) {
+	out := blockchain.TxOutput{Value: 20, PubKeyHash: vectorPKH()}
+	checkEncoding(t, "output", out.Serialize(), outputVector)
+	decodedOut, err := blockchain.DeserializeTxOutput(decodeHex(t, outputVector))
+	if err != nil {
+		t.Fatalf("output: %v", err)
+	}
+	checkEncoding(t, "decoded output", decodedOut.Serialize(), outputVector)
+
+	in := blockchain.TxInput{ID: bytes.Repeat([]byte{0xaa}, 32), Out: 1, Signature: []byte{1, 2, 3}, PubKey: []byte{4, 5}}
+	checkEncoding(t, "input", in.Serialize(), inputVector)
+	decodedIn, err := blockchain.DeserializeTxInput(decodeHex(t, inputVector))
+	if err != nil {
+		t.Fatalf("input: %v", err)
+	}
+	checkEncoding(t, "decoded input", decodedIn.Serialize(), inputVector)
+
+	txs := []struct {
+		name   string
+		tx     *blockchain.Transaction
+		vector string
+		id     string
+	}{
+		{"coinbase", vectorCoinbase(), coinbaseVector, coinbaseID},
+		{"spend", vectorSpend(), spendVector, spendID},
+	}
+	for _, test := range txs {
+		checkEncoding(t, test.name, test.tx.Serialize(), test.vector)
+		if id := hex.EncodeToString(test.tx.Hash()); id != test.id {
+			t.Errorf("%s: ID %s, want %s", test.name, id, test.id)
+		}
+
+		decoded, err := blockchain.DeserializeTransaction(decodeHex(t, test.vector))
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		checkEncoding(t, "decoded "+test.name, decoded.Serialize(), test.vector)
+		if id := hex.EncodeToString(decoded.ID); id != test.id {
+			t.Errorf("decoded %s: ID %s, want %s", test.name, id, test.id)
+		}
+	}
+
+	block := vectorBlock()
+	checkEncoding(t, "header", block.BlockHeader.Serialize(), headerVector)
+	checkEncoding(t, "block", block.Serialize(), blockVector)
+	if hash := hex.EncodeToString(block.Hash); hash != blockHash {
+		t.Errorf("block hash %s, want %s", hash, blockHash)
+	}
+
+	decoded, err := blockchain.DeserializeBlock(decodeHex(t, blockVector))
+	if err != nil {
+		t.Fatalf("block: %v", err)
+	}
+	checkEncoding(t, "decoded block", decoded.Serialize(), blockVector)
+	if hash := hex.EncodeToString(decoded.Hash); hash != blockHash {
+		t.Errorf("decoded block hash %s, want %s", hash, blockHash)
+	}
+}
+
+func TestEncodingRejects(t *testing.T) {
+	decodeTx := func(data []byte) error {
+		_, err := blockchain.DeserializeTransaction(data)
+		return err
+	}
+	decodeOutput := func(data []byte) error {
+		_, err := blockchain.DeserializeTxOutput(data)
+		return err
+	}
+	decodeBlock := func(data []byte) error {
+		_, err := blockchain.DeserializeBlock(data)
+		return err
+	}
+
+	tests := []struct {
+		name   string
+		decode func([]byte) error
+		data   string
+		want   error
+	}{
+		{"overlong varint", decodeOutput, "a800" + outputVector[2:], blockchain.ErrNonCanonical},
+		{"overlong count", decodeTx, "018100" + coinbaseVector[4:], blockchain.ErrNonCanonical},
+		{"trailing bytes after a transaction", decodeTx, coinbaseVector + "00", blockchain.ErrNonCanonical},
+		{"trailing bytes after an output", decodeOutput, outputVector + "00", blockchain.ErrNonCanonical},
+		{"empty seal", decodeBlock, blockVector + "00", blockchain.ErrNonCanonical},
+		{"truncated transaction", decodeTx, coinbaseVector[:len(coinbaseVector)-2], blockchain.ErrTruncatedData},
+		{"truncated block", decodeBlock, blockVector[:len(blockVector)-2], blockchain.ErrTruncatedData},
+		{"transaction version", decodeTx, "02" + coinbaseVector[2:], blockchain.ErrBadEncodingVersion},
+		{"block version", decodeBlock, "02" + blockVector[2:], blockchain.ErrBadEncodingVersion},
+	}
+	for _, test := range tests {
+		if err := test.decode(decodeHex(t, test.data)); !errors.Is(err, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package blockchain
+
+import (
+	"context"
+	"math/big"
+)
+
+// Engine is the consensus rule that decides who may create a block and how
+// the chain with the most weight is chosen. The engines are implemented in
+// the consensus package.
+type Engine interface {
+	// Seal completes block so that VerifyHeader accepts it: it sets the
+	// nonce for proof-of-work, the signature for proof-of-authority. It
+	// returns the context error when ctx is done first.
+	Seal(ctx context.Context, block *Block) error
+
+	// VerifyHeader checks the seal of a header on its own, without the
+	// chain it belongs to.
+	VerifyHeader(header *BlockHeader, seal []byte) error
+
+	// CalcDifficulty returns the bits a block on top of parent must use,
+	// parent is nil for the genesis block.
+	CalcDifficulty(chain *Blockchain, parent *BlockHeader) (uint32, error)
+
+	// Work is the weight of a block in the fork choice.
+	Work(header *BlockHeader) *big.Int
+}
@@ -0,0 +1,87 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	BlockVersion = 1
+	HashLength   = 32
+	HeaderLength = 4 + HashLength + HashLength + 8 + 4 + 4 + 4
+)
+
+var ErrBadHeaderLength = errors.New("block header has wrong length")
+
+// BlockHeader holds every field committed to by the block hash. It can be
+// relayed and checked without the transactions of the block.
+type BlockHeader struct {
+	Version    uint32
+	PrevHash   []byte // empty for the genesis block
+	MerkleRoot []byte // root of the merkle tree of the block transactions
+	Timestamp  int64
+	Bits       uint32 // target in compact form
+	Nonce      uint32
+	Height     int
+}
+
+// Serialize writes the header in its canonical form, all integers big endian:
+//
+//	version(4) | prev hash(32) | merkle root(32) | timestamp(8) | bits(4) | nonce(4) | height(4)
+//
+// The genesis block has an all zero previous hash.
+func (h *BlockHeader) Serialize() []byte {
+	data := make([]byte, HeaderLength)
+	offset := 0
+
+	binary.BigEndian.PutUint32(data[offset:], h.Version)
+	offset += 4
+	copy(data[offset:offset+HashLength], h.PrevHash)
+	offset += HashLength
+	copy(data[offset:offset+HashLength], h.MerkleRoot)
+	offset += HashLength
+	binary.BigEndian.PutUint64(data[offset:], uint64(h.Timestamp))
+	offset += 8
+	binary.BigEndian.PutUint32(data[offset:], h.Bits)
+	offset += 4
+	binary.BigEndian.PutUint32(data[offset:], h.Nonce)
+	offset += 4
+	binary.BigEndian.PutUint32(data[offset:], uint32(h.Height))
+
+	return data
+}
+
+func DeserializeBlockHeader(data []byte) (*BlockHeader, error) {
+	if len(data) != HeaderLength {
+		return nil, ErrBadHeaderLength
+	}
+
+	h := &BlockHeader{}
+	offset := 0
+
+	h.Version = binary.BigEndian.Uint32(data[offset:])
+	offset += 4
+	h.PrevHash = append([]byte{}, data[offset:offset+HashLength]...)
+	if bytes.Equal(h.PrevHash, make([]byte, HashLength)) {
+		h.PrevHash = []byte{}
+	}
+	offset += HashLength
+	h.MerkleRoot = append([]byte{}, data[offset:offset+HashLength]...)
+	offset += HashLength
+	h.Timestamp = int64(binary.BigEndian.Uint64(data[offset:]))
+	offset += 8
+	h.Bits = binary.BigEndian.Uint32(data[offset:])
+	offset += 4
+	h.Nonce = binary.BigEndian.Uint32(data[offset:])
+	offset += 4
+	h.Height = int(binary.BigEndian.Uint32(data[offset:]))
+
+	return h, nil
+}
+
+func (h *BlockHeader) Hash() []byte {
+	hash := sha256.Sum256(h.Serialize())
+	return hash[:]
+}
@@ -0,0 +1,139 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/phnaharris/harris-blockchain-token/storage"
+)
+
+// The height index maps the height of every block of the active chain to its
+// hash, it follows the tip through reorganizations.
+var heightIndexPrefix = []byte("height-")
+
+var ErrHeightOutOfRange = errors.New("no block at this height in the active chain")
+
+func heightKey(height int) []byte {
+	key := make([]byte, len(heightIndexPrefix)+4)
+	copy(key, heightIndexPrefix)
+	binary.BigEndian.PutUint32(key[len(heightIndexPrefix):], uint32(height))
+
+	return key
+}
+
+func (chain *Blockchain) indexHeight(batch storage.Batch, block *Block) error {
+	return batch.Put(heightKey(block.Height), block.Hash)
+}
+
+func (chain *Blockchain) unindexHeight(batch storage.Batch, block *Block) error {
+	return batch.Delete(heightKey(block.Height))
+}
+
+// GetBlockHashByHeight returns the hash of the active chain block at height.
+func (chain *Blockchain) GetBlockHashByHeight(height int) ([]byte, error) {
+	if height < 0 {
+		return nil, ErrHeightOutOfRange
+	}
+
+	hash, err := chain.Database.Get(heightKey(height))
+	if err == storage.ErrNotFound {
+		return nil, ErrHeightOutOfRange
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return hash, nil
+}
+
+// GetBlockByHeight returns the active chain block at height.
+func (chain *Blockchain) GetBlockByHeight(height int) (Block, error) {
+	hash, err := chain.GetBlockHashByHeight(height)
+	if err != nil {
+		return Block{}, fmt.Errorf("%w: %d", err, height)
+	}
+
+	return chain.GetBlock(hash)
+}
+
+// GetBlockHashesRange returns the hashes of the active chain blocks from
+// height from to height to, both included, in height order. The range stops
+// at the tip.
+func (chain *Blockchain) GetBlockHashesRange(from, to int) ([][]byte, error) {
+	var hashes [][]byte
+	if from < 0 {
+		from = 0
+	}
+
+	err := chain.Database.Iterate(heightIndexPrefix, heightKey(from), func(key, hash []byte) bool {
+		if int(binary.BigEndian.Uint32(key[len(heightIndexPrefix):])) > to {
+			return false
+		}
+		hashes = append(hashes, hash)
+		return true
+	})
+
+	return hashes, err
+}
+
+// checkHeightIndex rebuilds the height index if it does not end at the tip,
+// which is the case after a crash while it was rebuilt.
+func (chain *Blockchain) checkHeightIndex() error {
+	tip, err := chain.GetBlock(chain.LastHash())
+	if err != nil {
+		return err
+	}
+
+	if hash, err := chain.GetBlockHashByHeight(tip.Height); err == nil && bytes.Equal(hash, tip.Hash) {
+		return nil
+	}
+	return chain.reindexHeights()
+}
+
+// reindexHeights rebuilds the height index from the active chain. The height
+// of the tip, which checkHeightIndex looks at, is removed first and written
+// last, an index left partial by a crash is rebuilt again on startup.
+func (chain *Blockchain) reindexHeights() error {
+	tip, err := chain.GetBlock(chain.LastHash())
+	if err != nil {
+		return err
+	}
+	if err := chain.Database.Delete(heightKey(tip.Height)); err != nil {
+		return err
+	}
+
+	UTXOSet := UTXOSet{chain}
+	if err := UTXOSet.DeleteByPrefix(heightIndexPrefix); err != nil {
+		return err
+	}
+
+	hashes := make([][]byte, tip.Height+1)
+	iter := chain.Iterator()
+	for {
+		block, err := iter.Next()
+		if err != nil {
+			return err
+		}
+		if block.Height < 0 || block.Height >= len(hashes) {
+			return fmt.Errorf("%w: block %x at height %d", ErrInvalidHeight, block.Hash, block.Height)
+		}
+		hashes[block.Height] = block.Hash
+
+		if len(block.PrevHash) == 0 {
+			break
+		}
+	}
+
+	for height, hash := range hashes {
+		err := chain.Database.Update(func(batch storage.Batch) error {
+			return batch.Put(heightKey(height), hash)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
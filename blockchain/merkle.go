@@ -2,9 +2,11 @@ package blockchain
 
 import (
 	"crypto/sha256"
-	"log"
+	"errors"
 )
 
+var ErrNoMerkleNode = errors.New("merkle tree needs at least one node")
+
 type MerkleTree struct {
 	RootNode *MerkleNode
 }
@@ -31,7 +33,7 @@ func NewMerkleNode(left, right *MerkleNode, data []byte) *MerkleNode {
 	return &node
 }
 
-func NewMerkleTree(data [][]byte) *MerkleTree {
+func NewMerkleTree(data [][]byte) (*MerkleTree, error) {
 	var nodes []MerkleNode
 
 	for _, tx := range data {
@@ -40,7 +42,7 @@ func NewMerkleTree(data [][]byte) *MerkleTree {
 	}
 
 	if len(nodes) == 0 {
-		log.Panic("No merkle node!")
+		return nil, ErrNoMerkleNode
 	}
 
 	for len(nodes) > 1 {
@@ -59,5 +61,5 @@ func NewMerkleTree(data [][]byte) *MerkleTree {
 	}
 
 	tree := MerkleTree{&nodes[0]}
-	return &tree
+	return &tree, nil
 }
@@ -0,0 +1,330 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/phnaharris/harris-blockchain-token/storage"
+)
+
+var (
+	chainWorkPrefix = []byte("cw-")
+	// blocks of a side chain that failed to connect are kept, flagged
+	// invalid so that their descendants are rejected at once
+	invalidPrefix = []byte("invalid-")
+)
+
+var (
+	ErrInvalidBlock    = errors.New("block is known to be invalid")
+	ErrInvalidAncestor = errors.New("block descends from an invalid block")
+)
+
+// TipChange lists the blocks that left and joined the active chain.
+type TipChange struct {
+	Disconnected []*Block // from the old tip down to the fork point
+	Connected    []*Block // from the fork point up to the new tip
+}
+
+func chainWorkKey(hash []byte) []byte {
+	return append(append([]byte{}, chainWorkPrefix...), hash...)
+}
+
+// ChainWork returns the total work of the chain ending at hash, zero for the
+// empty parent of the genesis block.
+func (chain *Blockchain) ChainWork(hash []byte) (*big.Int, error) {
+	if len(hash) == 0 {
+		return new(big.Int), nil
+	}
+
+	stored, err := chain.Database.Get(chainWorkKey(hash))
+	if err == storage.ErrNotFound {
+		return nil, fmt.Errorf("%w: no chain work for %x", ErrBlockNotFound, hash)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return new(big.Int).SetBytes(stored), nil
+}
+
+func invalidKey(hash []byte) []byte {
+	return append(append([]byte{}, invalidPrefix...), hash...)
+}
+
+// IsInvalid tells if the block of hash failed to connect.
+func (chain *Blockchain) IsInvalid(hash []byte) (bool, error) {
+	_, err := chain.Database.Get(invalidKey(hash))
+	if err == storage.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// markInvalid flags blocks, which are stored, as invalid.
+func (chain *Blockchain) markInvalid(blocks []*Block) error {
+	return chain.Database.Update(func(batch storage.Batch) error {
+		for _, block := range blocks {
+			if err := batch.Put(invalidKey(block.Hash), []byte{1}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// connectBlock makes a validated block whose parent is the tip the new tip.
+// The block, its chain work, the UTXO changes with their undo data, the
+// indexes and the tip are written in one batch, so the chain state on disk is
+// always the one of the tip.
+func (chain *Blockchain) connectBlock(block *Block) error {
+	work, err := chain.ChainWork(block.PrevHash)
+	if err != nil {
+		return err
+	}
+	work.Add(work, chain.Engine.Work(&block.BlockHeader))
+	txIndex, err := chain.TxIndexEnabled()
+	if err != nil {
+		return err
+	}
+	addrIndex, err := chain.AddrIndexEnabled()
+	if err != nil {
+		return err
+	}
+
+	err = chain.Database.Update(func(batch storage.Batch) error {
+		if err := batch.Put(block.Hash, block.Serialize()); err != nil {
+			return err
+		}
+		if err := batch.Put(chainWorkKey(block.Hash), work.Bytes()); err != nil {
+			return err
+		}
+
+		UTXOSet := UTXOSet{chain}
+		undo, err := UTXOSet.Update(batch, block)
+		if err != nil {
+			return err
+		}
+
+		if err := chain.indexHeight(batch, block); err != nil {
+			return err
+		}
+		if txIndex {
+			if err := chain.indexTransactions(batch, block); err != nil {
+				return err
+			}
+		}
+		if addrIndex {
+			var spent []TxOutput
+			for _, entry := range undo.SpentOutputs {
+				spent = append(spent, entry.Output())
+			}
+			if err := chain.indexAddresses(batch, block, spent); err != nil {
+				return err
+			}
+		}
+
+		return batch.Put([]byte("lh"), block.Hash)
+	})
+	if err != nil {
+		return err
+	}
+
+	chain.lastHash.Store(block.Hash)
+	return nil
+}
+
+// unindexBlock removes the block from the height index and the enabled
+// optional indexes.
+func (chain *Blockchain) unindexBlock(batch storage.Batch, block *Block) error {
+	if err := chain.unindexHeight(batch, block); err != nil {
+		return err
+	}
+
+	txIndex, err := chain.TxIndexEnabled()
+	if err != nil {
+		return err
+	}
+	if txIndex {
+		if err := chain.unindexTransactions(batch, block); err != nil {
+			return err
+		}
+	}
+
+	addrIndex, err := chain.AddrIndexEnabled()
+	if err != nil {
+		return err
+	}
+	if addrIndex {
+		return chain.unindexAddresses(batch, block)
+	}
+
+	return nil
+}
+
+// disconnectBlock moves the tip back to the parent of the tip block, in one
+// batch like connectBlock.
+func (chain *Blockchain) disconnectBlock(block *Block) error {
+	err := chain.Database.Update(func(batch storage.Batch) error {
+		UTXOSet := UTXOSet{chain}
+		if err := UTXOSet.Disconnect(batch, block); err != nil {
+			return err
+		}
+		if err := chain.unindexBlock(batch, block); err != nil {
+			return err
+		}
+
+		return batch.Put([]byte("lh"), block.PrevHash)
+	})
+	if err != nil {
+		return err
+	}
+
+	chain.lastHash.Store(block.PrevHash)
+	return nil
+}
+
+// disconnectBlocks moves the tip back through blocks, listed from the tip
+// down, using their undo data.
+func (chain *Blockchain) disconnectBlocks(blocks []*Block) error {
+	for _, block := range blocks {
+		if err := chain.disconnectBlock(block); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkChainState repairs a UTXO set that is not at the tip, left by a crash
+// while the UTXO set was rebuilt: the UTXO set and the indexes are rebuilt
+// from the blocks.
+func (chain *Blockchain) checkChainState() error {
+	utxoTip, err := chain.Database.Get(utxoTipKey)
+	if err == nil && bytes.Equal(utxoTip, chain.LastHash()) {
+		return nil
+	}
+	if err != nil && err != storage.ErrNotFound {
+		return err
+	}
+
+	fmt.Println("The chain state is not at the tip, rebuilding it...")
+	UTXOSet := UTXOSet{chain}
+	if err := UTXOSet.Reindex(); err != nil {
+		return err
+	}
+	if err := chain.reindexHeights(); err != nil {
+		return err
+	}
+
+	txIndex, err := chain.TxIndexEnabled()
+	if err != nil {
+		return err
+	}
+	if txIndex {
+		if _, err := chain.ReindexTransactions(); err != nil {
+			return err
+		}
+	}
+
+	addrIndex, err := chain.AddrIndexEnabled()
+	if err != nil {
+		return err
+	}
+	if addrIndex {
+		if _, err := chain.ReindexAddresses(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// reorganize switches the active chain to the branch ending at newTip. If a
+// block of the new branch is invalid the old chain is restored.
+func (chain *Blockchain) reorganize(newTip *Block) (*TipChange, error) {
+	change := &TipChange{}
+
+	oldTip, err := chain.GetBlock(chain.LastHash())
+	if err != nil {
+		return nil, err
+	}
+
+	// find the fork point
+	oldBlock, newBlock := &oldTip, newTip
+	var connected []*Block
+	for !bytes.Equal(oldBlock.Hash, newBlock.Hash) {
+		if oldBlock.Height < newBlock.Height {
+			// the branch cannot become active through an invalid block
+			invalid, err := chain.IsInvalid(newBlock.Hash)
+			if err != nil {
+				return nil, err
+			}
+			if invalid {
+				if err := chain.markInvalid(connected); err != nil {
+					return nil, err
+				}
+				return nil, fmt.Errorf("%w: %x", ErrInvalidAncestor, newBlock.Hash)
+			}
+		}
+
+		if oldBlock.Height >= newBlock.Height {
+			change.Disconnected = append(change.Disconnected, oldBlock)
+			parent, err := chain.GetBlock(oldBlock.PrevHash)
+			if err != nil {
+				return nil, err
+			}
+			oldBlock = &parent
+		} else {
+			connected = append(connected, newBlock)
+			parent, err := chain.GetBlock(newBlock.PrevHash)
+			if err != nil {
+				return nil, err
+			}
+			newBlock = &parent
+		}
+	}
+	for i := len(connected) - 1; i >= 0; i-- {
+		change.Connected = append(change.Connected, connected[i])
+	}
+
+	if err := chain.disconnectBlocks(change.Disconnected); err != nil {
+		return nil, err
+	}
+
+	for i, block := range change.Connected {
+		if err := chain.checkBlockTransactions(block); err != nil {
+			// the block and the blocks above it cannot become active
+			if err := chain.markInvalid(change.Connected[i:]); err != nil {
+				return nil, err
+			}
+
+			// undo the part of the new branch that was connected and
+			// restore the old chain
+			var undo []*Block
+			for j := i - 1; j >= 0; j-- {
+				undo = append(undo, change.Connected[j])
+			}
+			if err := chain.disconnectBlocks(undo); err != nil {
+				return nil, err
+			}
+
+			for i := len(change.Disconnected) - 1; i >= 0; i-- {
+				if err := chain.connectBlock(change.Disconnected[i]); err != nil {
+					return nil, err
+				}
+			}
+			return nil, err
+		}
+		if err := chain.connectBlock(block); err != nil {
+			return nil, err
+		}
+	}
+
+	return change, nil
+}
@@ -0,0 +1,184 @@
+package blockchain_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/phnaharris/harris-blockchain-token/blockchain"
+	"github.com/phnaharris/harris-blockchain-token/wallet"
+)
+
+// sealBlockOn mines a block on top of parent, which may be off the active
+// chain, whose coinbase pays value to address. The block is not added.
+func sealBlockOn(t *testing.T, chain *blockchain.Blockchain, parent *blockchain.Block, address string, value int) *blockchain.Block {
+	t.Helper()
+
+	coinbase, err := blockchain.CoinbaseTx(address, "", value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bits, err := chain.Engine.CalcDifficulty(chain, &parent.BlockHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := blockchain.NewBlock([]*blockchain.Transaction{coinbase}, parent.Hash, parent.Height+1, bits)
+	block.Timestamp = parent.Timestamp + 1
+	if err := chain.Engine.Seal(context.Background(), block); err != nil {
+		t.Fatal(err)
+	}
+
+	return block
+}
+
+// checkActiveChain checks the active chain is made of blocks, from the tip
+// down to the genesis block.
+func checkActiveChain(t *testing.T, chain *blockchain.Blockchain, blocks ...*blockchain.Block) {
+	t.Helper()
+
+	hashes, err := chain.GetBlockHashes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hashes) != len(blocks) {
+		t.Fatalf("active chain has %d blocks, want %d", len(hashes), len(blocks))
+	}
+	for i, block := range blocks {
+		if !bytes.Equal(hashes[i], block.Hash) {
+			t.Errorf("active block at height %d is %x, want %x", len(blocks)-1-i, hashes[i], block.Hash)
+		}
+	}
+	if !bytes.Equal(chain.LastHash(), blocks[0].Hash) {
+		t.Errorf("tip is %x, want %x", chain.LastHash(), blocks[0].Hash)
+	}
+}
+
+// checkCoinbase checks if the coinbase output of block is unspent.
+func checkCoinbase(t *testing.T, chain *blockchain.Blockchain, block *blockchain.Block, want bool) {
+	t.Helper()
+
+	utxo := blockchain.UTXOSet{Chain: chain}
+	_, err := utxo.FindEntry(block.Transaction[0].ID, 0)
+	if err != nil && !errors.Is(err, blockchain.ErrMissingInput) {
+		t.Fatal(err)
+	}
+	if got := err == nil; got != want {
+		t.Errorf("coinbase of block %d is unspent: %v, want %v", block.Height, got, want)
+	}
+}
+
+// forkChain returns a chain with two blocks on top of its genesis block.
+func forkChain(t *testing.T) (chain *blockchain.Blockchain, address string, genesis, a1, a2 *blockchain.Block) {
+	t.Helper()
+
+	chain = newTestChain(t)
+	w, err := wallet.MakeWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	address = string(w.Address(chain.Params))
+
+	block, err := chain.GetBlockByHeight(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesis = &block
+	a1 = mineBlock(t, chain, address, nil)
+	a2 = mineBlock(t, chain, address, nil)
+
+	return chain, address, genesis, a1, a2
+}
+
+func TestReorganize(t *testing.T) {
+	chain, address, genesis, a1, a2 := forkChain(t)
+	subsidy := chain.Params.Subsidy.BlockSubsidy(1)
+
+	// a side chain becomes active once it has more work, not as much
+	b1 := sealBlockOn(t, chain, genesis, address, subsidy)
+	b2 := sealBlockOn(t, chain, b1, address, subsidy)
+	for _, block := range []*blockchain.Block{b1, b2} {
+		change, err := chain.AddBlock(block)
+		if err != nil {
+			t.Fatalf("side block %d: %v", block.Height, err)
+		}
+		if len(change.Connected) != 0 || len(change.Disconnected) != 0 {
+			t.Errorf("side block %d changed the tip", block.Height)
+		}
+	}
+	checkActiveChain(t, chain, a2, a1, genesis)
+
+	b3 := sealBlockOn(t, chain, b2, address, subsidy)
+	change, err := chain.AddBlock(b3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(change.Disconnected) != 2 || len(change.Connected) != 3 {
+		t.Fatalf("reorganization disconnected %d blocks and connected %d, want 2 and 3", len(change.Disconnected), len(change.Connected))
+	}
+	if !bytes.Equal(change.Disconnected[0].Hash, a2.Hash) || !bytes.Equal(change.Connected[2].Hash, b3.Hash) {
+		t.Errorf("tip change goes from %x to %x, want from a2 to b3", change.Disconnected[0].Hash, change.Connected[2].Hash)
+	}
+	checkActiveChain(t, chain, b3, b2, b1, genesis)
+
+	for _, block := range []*blockchain.Block{a1, a2} {
+		checkCoinbase(t, chain, block, false)
+	}
+	for _, block := range []*blockchain.Block{b1, b2, b3} {
+		checkCoinbase(t, chain, block, true)
+	}
+}
+
+func TestReorganizeInvalidBranch(t *testing.T) {
+	chain, address, genesis, a1, a2 := forkChain(t)
+	subsidy := chain.Params.Subsidy.BlockSubsidy(1)
+
+	// b2 pays itself too much, which is only found once b1 is connected
+	b1 := sealBlockOn(t, chain, genesis, address, subsidy)
+	b2 := sealBlockOn(t, chain, b1, address, subsidy+1)
+	b3 := sealBlockOn(t, chain, b2, address, subsidy)
+	for _, block := range []*blockchain.Block{b1, b2} {
+		if _, err := chain.AddBlock(block); err != nil {
+			t.Fatalf("side block %d: %v", block.Height, err)
+		}
+	}
+	if _, err := chain.AddBlock(b3); !errors.Is(err, blockchain.ErrBadCoinbaseValue) {
+		t.Fatalf("heavier invalid branch: got %v, want ErrBadCoinbaseValue", err)
+	}
+
+	// the old chain is back
+	checkActiveChain(t, chain, a2, a1, genesis)
+	checkCoinbase(t, chain, a1, true)
+	checkCoinbase(t, chain, a2, true)
+	checkCoinbase(t, chain, b1, false)
+
+	for _, test := range []struct {
+		block *blockchain.Block
+		want  bool
+	}{{b1, false}, {b2, true}, {b3, true}} {
+		invalid, err := chain.IsInvalid(test.block.Hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if invalid != test.want {
+			t.Errorf("block %d is flagged invalid: %v, want %v", test.block.Height, invalid, test.want)
+		}
+	}
+
+	if _, err := chain.AddBlock(b2); !errors.Is(err, blockchain.ErrInvalidBlock) {
+		t.Errorf("invalid block added again: got %v, want ErrInvalidBlock", err)
+	}
+	if _, err := chain.AddBlock(sealBlockOn(t, chain, b3, address, subsidy)); !errors.Is(err, blockchain.ErrInvalidAncestor) {
+		t.Errorf("child of an invalid block: got %v, want ErrInvalidAncestor", err)
+	}
+
+	// the valid part of the branch can still become active
+	c2 := sealBlockOn(t, chain, b1, address, subsidy)
+	c3 := sealBlockOn(t, chain, c2, address, subsidy)
+	for _, block := range []*blockchain.Block{c2, c3} {
+		if _, err := chain.AddBlock(block); err != nil {
+			t.Fatalf("valid side block %d: %v", block.Height, err)
+		}
+	}
+	checkActiveChain(t, chain, c3, c2, b1, genesis)
+}
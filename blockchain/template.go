@@ -0,0 +1,179 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"sort"
+)
+
+// MaxBlockSize is the largest encoded block, in bytes, a valid block can have.
+const MaxBlockSize = 1 << 20
+
+// BlockTemplate is a block on top of the tip that only needs a proof-of-work.
+// Its coinbase pays Subsidy plus Fees to the miner.
+type BlockTemplate struct {
+	Block   *Block
+	Subsidy int
+	Fees    int
+}
+
+// templateTx is a mempool transaction with its fee and encoded size.
+type templateTx struct {
+	tx   *Transaction
+	fee  int
+	size int
+}
+
+// encodedSize is the size a transaction takes in the block encoding.
+func encodedSize(tx *Transaction) int {
+	var buf [binary.MaxVarintLen64]byte
+	size := len(tx.Serialize())
+
+	return binary.PutUvarint(buf[:], uint64(size)) + size
+}
+
+// NewBlockTemplate builds the next block from the transactions of a mempool.
+// Transactions go by decreasing fee rate, a transaction spending outputs of
+// another unconfirmed transaction waits for it to be included first, and
+// invalid transactions or ones that do not fit in MaxBlockSize are left out.
+func (chain *Blockchain) NewBlockTemplate(mempool []*Transaction, minerAddress string) (*BlockTemplate, error) {
+	chain.mu.RLock()
+	defer chain.mu.RUnlock()
+
+	tip, err := chain.GetBlock(chain.LastHash())
+	if err != nil {
+		return nil, err
+	}
+	height := tip.Height + 1
+	subsidy := chain.Params.Subsidy.BlockSubsidy(height)
+
+	// the coinbase value is known at the end, keep room for the largest one
+	// and for the extra-nonce the miner appends to it
+	coinbase, err := CoinbaseTx(minerAddress, "", subsidy)
+	if err != nil {
+		return nil, err
+	}
+	size := 1 + HeaderLength + binary.MaxVarintLen64 +
+		encodedSize(coinbase) + 8 + 2*binary.MaxVarintLen64
+
+	candidates := chain.templateCandidates(mempool)
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if rateA, rateB := a.fee*b.size, b.fee*a.size; rateA != rateB {
+			return rateA > rateB
+		}
+		return bytes.Compare(a.tx.ID, b.tx.ID) < 0
+	})
+
+	view := chain.newBlockView(height)
+	txs := []*Transaction{coinbase}
+	fees := 0
+
+	for added := true; added; {
+		added = false
+		remaining := candidates[:0]
+
+		for _, c := range candidates {
+			if size+c.size > MaxBlockSize {
+				continue
+			}
+
+			fee, err := view.checkTransaction(c.tx)
+			if errors.Is(err, ErrMissingInput) {
+				// the parent may still be added in this pass
+				remaining = append(remaining, c)
+				continue
+			}
+			if err != nil {
+				continue
+			}
+			total, ok := addValue(fees, fee, view.maxMoney)
+			if !ok {
+				continue
+			}
+
+			view.add(c.tx)
+			txs = append(txs, c.tx)
+			fees = total
+			size += c.size
+			added = true
+		}
+
+		candidates = remaining
+	}
+
+	coinbase.Outputs[0].Value = subsidy + fees
+	coinbase.ID = coinbase.Hash()
+
+	bits, err := chain.Engine.CalcDifficulty(chain, &tip.BlockHeader)
+	if err != nil {
+		return nil, err
+	}
+	block := NewBlock(txs, tip.Hash, height, bits)
+	block.Timestamp, err = chain.nextTimestamp(&tip.BlockHeader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &BlockTemplate{block, subsidy, fees}, nil
+}
+
+// templateCandidates drops the duplicate and coinbase transactions of a
+// mempool and works out the fee of the others, the outputs they spend being in
+// the UTXO set or in the mempool.
+func (chain *Blockchain) templateCandidates(mempool []*Transaction) []templateTx {
+	UTXOSet := UTXOSet{chain}
+	maxMoney := chain.Params.Subsidy.MaxSupply()
+
+	pool := make(map[string]*Transaction)
+	for _, tx := range mempool {
+		pool[hex.EncodeToString(tx.ID)] = tx
+	}
+
+	var candidates []templateTx
+
+Candidates:
+	for id, tx := range pool {
+		if tx.IsCoinbase() || id != hex.EncodeToString(tx.Hash()) {
+			continue
+		}
+
+		// the values are checked again in the block, here they only have to
+		// add up without wrapping around
+		inValue, outValue := 0, 0
+		for _, in := range tx.Inputs {
+			var value int
+			if parent, ok := pool[hex.EncodeToString(in.ID)]; ok {
+				if in.Out < 0 || in.Out >= len(parent.Outputs) {
+					continue Candidates
+				}
+				value = parent.Outputs[in.Out].Value
+			} else if out, err := UTXOSet.FindOutput(in.ID, in.Out); err == nil {
+				value = out.Value
+			} else {
+				continue Candidates
+			}
+
+			var ok bool
+			if inValue, ok = addValue(inValue, value, maxMoney); !ok {
+				continue Candidates
+			}
+		}
+		for _, out := range tx.Outputs {
+			var ok bool
+			if outValue, ok = addValue(outValue, out.Value, maxMoney); !ok {
+				continue Candidates
+			}
+		}
+		if inValue < outValue {
+			continue
+		}
+		fee := inValue - outValue
+
+		candidates = append(candidates, templateTx{tx, fee, encodedSize(tx)})
+	}
+
+	return candidates
+}
@@ -1,24 +1,22 @@
 package blockchain
 
 import (
-	"bytes"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
-	"encoding/gob"
 	"encoding/hex"
 	"errors"
 	"fmt"
-	"log"
 	"math/big"
 	"strings"
 
 	"github.com/phnaharris/harris-blockchain-token/wallet"
 )
 
-const (
-	Reward = 20
+var (
+	ErrNotEnoughFunds = errors.New("not enough funds")
+	ErrMissingPrevTx  = errors.New("previous transaction is not available")
 )
 
 type Transaction struct {
@@ -27,88 +25,105 @@ type Transaction struct {
 	Outputs []TxOutput
 }
 
+// Hash is the transaction ID: the SHA-256 of its canonical encoding, which
+// covers the signatures but not the ID itself.
 func (tx *Transaction) Hash() []byte {
-	var hash [32]byte
-
-	txCopy := *tx
-	txCopy.ID = []byte{}
-
-	hash = sha256.Sum256(txCopy.Serialize())
+	hash := sha256.Sum256(tx.Serialize())
 
 	return hash[:]
 }
 
 func (tx *Transaction) Serialize() []byte {
-	var res bytes.Buffer
-
-	encoder := gob.NewEncoder(&res)
-	err := encoder.Encode(tx)
-
-	Handle(err)
+	e := &encoder{}
+	e.writeTransaction(tx)
 
-	return res.Bytes()
+	return e.buffer.Bytes()
 }
 
-func DeserializeTransaction(data []byte) Transaction {
-	var tx Transaction
-
-	decoder := gob.NewDecoder(bytes.NewReader(data))
-	err := decoder.Decode(&tx)
+func DeserializeTransaction(data []byte) (Transaction, error) {
+	d := &decoder{data: data}
+	tx := d.readTransaction()
+	if err := d.finish(); err != nil {
+		return Transaction{}, err
+	}
 
-	Handle(err)
+	tx.ID = tx.Hash()
 
-	return tx
+	return *tx, nil
 }
 
-func CoinbaseTx(to, data string) *Transaction {
+// CoinbaseTx pays value, the block subsidy plus the fees of the block
+// transactions, to the miner.
+func CoinbaseTx(to, data string, value int) (*Transaction, error) {
 	var tx *Transaction
 
 	if len(data) == 0 {
 		randData := make([]byte, 24)
-		_, err := rand.Read(randData)
-		Handle(err)
+		if _, err := rand.Read(randData); err != nil {
+			return nil, err
+		}
 		data = fmt.Sprintf("%x", randData)
 	}
 
 	txIn := TxInput{[]byte{}, -1, nil, []byte(data)}
-	txOut := NewTxOutput(Reward, to)
+	txOut, err := NewTxOutput(value, to)
+	if err != nil {
+		return nil, err
+	}
 	tx = &Transaction{nil, []TxInput{txIn}, []TxOutput{*txOut}}
 	tx.ID = tx.Hash()
 
-	return tx
+	return tx, nil
 }
 
-func NewTransaction(w *wallet.Wallet, to string, amount int, UTXO *UTXOSet) *Transaction {
+// NewTransaction sends amount to an address and leaves fee to the miner, the
+// rest of the spent outputs goes back to the wallet as change.
+func NewTransaction(w *wallet.Wallet, to string, amount, fee int, UTXO *UTXOSet) (*Transaction, error) {
 	var inputs []TxInput
 	var outputs []TxOutput
 
 	pubKeyHash := wallet.PublicKeyHash(w.PublicKey)
-	accumulated, validOutputs := UTXO.FindSpendableOutputs(pubKeyHash, amount)
+	accumulated, validOutputs, err := UTXO.FindSpendableOutputs(pubKeyHash, amount+fee)
+	if err != nil {
+		return nil, err
+	}
 
-	if accumulated < amount {
-		log.Panic("Error: Not enough funds! Please deposit!")
+	if accumulated < amount+fee {
+		return nil, fmt.Errorf("%w: have %d, need %d", ErrNotEnoughFunds, accumulated, amount+fee)
 	}
 
 	for txid, outs := range validOutputs {
 		txID, err := hex.DecodeString(txid)
-		Handle(err)
+		if err != nil {
+			return nil, err
+		}
 		for _, out := range outs {
 			input := TxInput{txID, out, nil, w.PublicKey}
 			inputs = append(inputs, input)
 		}
 	}
 
-	from := fmt.Sprintf("%s", w.Address())
+	from := fmt.Sprintf("%s", w.Address(UTXO.Chain.Params))
 
-	outputs = append(outputs, *NewTxOutput(amount, to))
-	if accumulated > amount {
-		outputs = append(outputs, *NewTxOutput(accumulated-amount, from))
+	out, err := NewTxOutput(amount, to)
+	if err != nil {
+		return nil, err
+	}
+	outputs = append(outputs, *out)
+	if accumulated > amount+fee {
+		change, err := NewTxOutput(accumulated-amount-fee, from)
+		if err != nil {
+			return nil, err
+		}
+		outputs = append(outputs, *change)
 	}
 
 	tx := Transaction{nil, inputs, outputs}
+	if err := UTXO.Chain.SignTransaction(&tx, w.PrivateKey); err != nil {
+		return nil, err
+	}
 	tx.ID = tx.Hash()
-	UTXO.Chain.SignTransaction(&tx, w.PrivateKey)
-	return &tx
+	return &tx, nil
 }
 
 func (tx *Transaction) IsCoinbase() bool {
@@ -119,34 +134,39 @@ func (tx *Transaction) IsCoinbase() bool {
 	return len(tx.Inputs) == 1 && len(tx.Inputs[0].ID) == 0 && tx.Inputs[0].Out == -1
 }
 
-func (tx *Transaction) Sign(privKey *ecdsa.PrivateKey, prevTxs map[string]Transaction) {
+func (tx *Transaction) Sign(privKey *ecdsa.PrivateKey, prevTxs map[string]Transaction) error {
 	if tx.IsCoinbase() {
-		return
+		return nil
 	}
 
 	// validate prevTxs
 	for _, in := range tx.Inputs {
-		if len(prevTxs[hex.EncodeToString(in.ID)].ID) == 0 {
-			Handle(errors.New("previous transaction is not available"))
+		prevTx := prevTxs[hex.EncodeToString(in.ID)]
+		if len(prevTx.ID) == 0 || in.Out < 0 || in.Out >= len(prevTx.Outputs) {
+			return fmt.Errorf("%w: %x", ErrMissingPrevTx, in.ID)
 		}
 	}
 
-	txCopied := tx.DeepCopy()
+	txCopied := tx.TrimmedCopy()
 
 	for inIdx, in := range txCopied.Inputs {
 		prevTx := prevTxs[hex.EncodeToString(in.ID)]
 		txCopied.Inputs[inIdx].Signature = nil
 		txCopied.Inputs[inIdx].PubKey = prevTx.Outputs[in.Out].PubKeyHash
 
-		dataToSign := fmt.Sprintf("%x\n", txCopied)
+		dataToSign := txCopied.Hash()
 
-		r, s, err := ecdsa.Sign(rand.Reader, privKey, []byte(dataToSign))
-		Handle(err)
+		r, s, err := ecdsa.Sign(rand.Reader, privKey, dataToSign)
+		if err != nil {
+			return err
+		}
 
 		signature := append(r.Bytes(), s.Bytes()...)
 		tx.Inputs[inIdx].Signature = signature
 		txCopied.Inputs[inIdx].PubKey = nil
 	}
+
+	return nil
 }
 
 func (tx *Transaction) Verify(prevTxs map[string]Transaction) bool {
@@ -154,14 +174,16 @@ func (tx *Transaction) Verify(prevTxs map[string]Transaction) bool {
 		return true
 	}
 
+	// a transaction spending unknown outputs is not valid
 	for _, in := range tx.Inputs {
-		if len(prevTxs[hex.EncodeToString(in.ID)].ID) == 0 {
-			Handle(errors.New("previous transaction is not available"))
+		prevTx := prevTxs[hex.EncodeToString(in.ID)]
+		if len(prevTx.ID) == 0 || in.Out < 0 || in.Out >= len(prevTx.Outputs) {
+			return false
 		}
 	}
 
 	// xem như đã có => sẽ quay lại sau
-	txCopy := tx.DeepCopy()
+	txCopy := tx.TrimmedCopy()
 	curve := elliptic.P256()
 
 	for inId, in := range tx.Inputs {
@@ -182,10 +204,10 @@ func (tx *Transaction) Verify(prevTxs map[string]Transaction) bool {
 		x.SetBytes(in.PubKey[:(keyLen / 2)])
 		y.SetBytes(in.PubKey[(keyLen / 2):])
 
-		dataToVerify := fmt.Sprintf("%x\n", txCopy)
+		dataToVerify := txCopy.Hash()
 
 		rawPubKey := ecdsa.PublicKey{Curve: curve, X: &x, Y: &y}
-		if !ecdsa.Verify(&rawPubKey, []byte(dataToVerify), &r, &s) {
+		if !ecdsa.Verify(&rawPubKey, dataToVerify, &r, &s) {
 			return false
 		}
 		txCopy.Inputs[inId].PubKey = nil
@@ -211,6 +233,18 @@ func (tx *Transaction) DeepCopy() *Transaction {
 	return &Transaction{txID, txInput, txOutput}
 }
 
+// TrimmedCopy is the transaction without signatures and public keys, the
+// form that is signed for each input.
+func (tx *Transaction) TrimmedCopy() *Transaction {
+	txCopy := tx.DeepCopy()
+	for i := range txCopy.Inputs {
+		txCopy.Inputs[i].Signature = nil
+		txCopy.Inputs[i].PubKey = nil
+	}
+
+	return txCopy
+}
+
 func (tx *Transaction) String() string {
 	var lines []string
 
@@ -2,7 +2,7 @@ package blockchain
 
 import (
 	"bytes"
-	"encoding/gob"
+	"fmt"
 
 	"github.com/phnaharris/harris-blockchain-token/wallet"
 )
@@ -19,55 +19,54 @@ type TxOutput struct {
 	PubKeyHash []byte // PubKeyHash of people who can unlock this output == address
 }
 
-type TxOutputs struct {
-	Outputs []TxOutput
+func (in *TxInput) UsesKey(pubKeyHash []byte) bool {
+	return bytes.Equal(wallet.PublicKeyHash(in.PubKey), pubKeyHash)
 }
 
-func (out *TxOutput) Lock(address []byte) {
+func (out *TxOutput) Lock(address []byte) error {
 	// lock a TxOutput to an address
-	versionHashed := wallet.Base58Decode(address)
+	versionHashed, err := wallet.Base58Decode(address)
+	if err != nil || len(versionHashed) <= 1+wallet.ChecksumLength {
+		return fmt.Errorf("%w: %q", wallet.ErrInvalidAddress, address)
+	}
 	pubKeyHash := versionHashed[1 : len(versionHashed)-wallet.ChecksumLength]
 	out.PubKeyHash = pubKeyHash
+
+	return nil
 }
 
 func (out *TxOutput) IsLockedWithKey(pubKeyHash []byte) bool {
 	return bytes.Equal(out.PubKeyHash, pubKeyHash)
 }
 
-func NewTxOutput(value int, address string) *TxOutput {
+func NewTxOutput(value int, address string) (*TxOutput, error) {
 	out := &TxOutput{value, nil}
-	out.Lock([]byte(address))
-	return out
+	if err := out.Lock([]byte(address)); err != nil {
+		return nil, err
+	}
+	return out, nil
 }
 
-// func (out TxOutput) Serialize() []byte {
-// 	var buffer bytes.Buffer
-// 	encode := gob.NewEncoder(&buffer)
-// 	err := encode.Encode(out)
-// 	Handle(err)
-// 	return buffer.Bytes()
-// }
+func (in TxInput) Serialize() []byte {
+	e := &encoder{}
+	e.writeInput(&in)
+	return e.buffer.Bytes()
+}
 
-func (outs TxOutputs) Serialize() []byte {
-	var buffer bytes.Buffer
-	encode := gob.NewEncoder(&buffer)
-	err := encode.Encode(outs)
-	Handle(err)
-	return buffer.Bytes()
+func DeserializeTxInput(data []byte) (TxInput, error) {
+	d := &decoder{data: data}
+	in := d.readInput()
+	return in, d.finish()
 }
 
-// func DeserializeTxOutput(data []byte) TxOutput {
-// 	var out TxOutput
-// 	decode := gob.NewDecoder(bytes.NewReader(data))
-// 	err := decode.Decode(&out)
-// 	Handle(err)
-// 	return out
-// }
+func (out TxOutput) Serialize() []byte {
+	e := &encoder{}
+	e.writeOutput(&out)
+	return e.buffer.Bytes()
+}
 
-func DeserializeTxOutputs(data []byte) TxOutputs {
-	var outs TxOutputs
-	decode := gob.NewDecoder(bytes.NewReader(data))
-	err := decode.Decode(&outs)
-	Handle(err)
-	return outs
+func DeserializeTxOutput(data []byte) (TxOutput, error) {
+	d := &decoder{data: data}
+	out := d.readOutput()
+	return out, d.finish()
 }
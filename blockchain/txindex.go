@@ -0,0 +1,171 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/phnaharris/harris-blockchain-token/storage"
+)
+
+// The transaction index maps the ID of every transaction of the active chain
+// to its block and position. It is optional: it is kept only while the
+// txIndexFlag key exists, FindTransaction walks the chain otherwise.
+var (
+	txIndexPrefix = []byte("txidx-")
+	txIndexFlag   = []byte("txindex")
+)
+
+var ErrTxNotFound = errors.New("transaction does not exist")
+
+// TxLocation is where a transaction is in the active chain.
+type TxLocation struct {
+	BlockHash []byte
+	Position  int // index in the block transactions
+}
+
+func txIndexKey(txID []byte) []byte {
+	return append(append([]byte{}, txIndexPrefix...), txID...)
+}
+
+func (l TxLocation) serialize() []byte {
+	data := make([]byte, len(l.BlockHash)+4)
+	copy(data, l.BlockHash)
+	binary.BigEndian.PutUint32(data[len(l.BlockHash):], uint32(l.Position))
+
+	return data
+}
+
+func deserializeTxLocation(data []byte) TxLocation {
+	return TxLocation{
+		BlockHash: append([]byte{}, data[:len(data)-4]...),
+		Position:  int(binary.BigEndian.Uint32(data[len(data)-4:])),
+	}
+}
+
+func (chain *Blockchain) TxIndexEnabled() (bool, error) {
+	_, err := chain.Database.Get(txIndexFlag)
+	if err == storage.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (chain *Blockchain) indexTransactions(batch storage.Batch, block *Block) error {
+	for i, tx := range block.Transaction {
+		location := TxLocation{block.Hash, i}
+		if err := batch.Put(txIndexKey(tx.ID), location.serialize()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (chain *Blockchain) unindexTransactions(batch storage.Batch, block *Block) error {
+	for _, tx := range block.Transaction {
+		if err := batch.Delete(txIndexKey(tx.ID)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// FindTxLocation looks a transaction up in the transaction index.
+func (chain *Blockchain) FindTxLocation(txID []byte) (TxLocation, error) {
+	data, err := chain.Database.Get(txIndexKey(txID))
+	if err == storage.ErrNotFound {
+		return TxLocation{}, fmt.Errorf("%w: %x", ErrTxNotFound, txID)
+	}
+	if err != nil {
+		return TxLocation{}, err
+	}
+
+	return deserializeTxLocation(data), nil
+}
+
+// GetTransaction returns a transaction of the active chain with the block
+// holding it, through the index when it is enabled.
+func (chain *Blockchain) GetTransaction(txID []byte) (*Transaction, *Block, error) {
+	indexed, err := chain.TxIndexEnabled()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if indexed {
+		location, err := chain.FindTxLocation(txID)
+		if err != nil {
+			return nil, nil, err
+		}
+		block, err := chain.GetBlock(location.BlockHash)
+		if err != nil {
+			return nil, nil, err
+		}
+		return block.Transaction[location.Position], &block, nil
+	}
+
+	iter := chain.Iterator()
+	for {
+		block, err := iter.Next()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, tx := range block.Transaction {
+			if bytes.Equal(txID, tx.ID) {
+				return tx, block, nil
+			}
+		}
+
+		if len(block.PrevHash) == 0 {
+			return nil, nil, fmt.Errorf("%w: %x", ErrTxNotFound, txID)
+		}
+	}
+}
+
+// ReindexTransactions rebuilds the transaction index from the active chain
+// and enables it. It returns the number of indexed transactions.
+func (chain *Blockchain) ReindexTransactions() (int, error) {
+	if err := chain.DropTxIndex(); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	iter := chain.Iterator()
+	for {
+		block, err := iter.Next()
+		if err != nil {
+			return count, err
+		}
+
+		err = chain.Database.Update(func(batch storage.Batch) error {
+			return chain.indexTransactions(batch, block)
+		})
+		if err != nil {
+			return count, err
+		}
+		count += len(block.Transaction)
+
+		if len(block.PrevHash) == 0 {
+			break
+		}
+	}
+
+	return count, chain.Database.Put(txIndexFlag, []byte{1})
+}
+
+// DropTxIndex disables the transaction index and deletes it.
+func (chain *Blockchain) DropTxIndex() error {
+	if err := chain.Database.Delete(txIndexFlag); err != nil {
+		return err
+	}
+
+	UTXOSet := UTXOSet{chain}
+	return UTXOSet.DeleteByPrefix(txIndexPrefix)
+}
@@ -0,0 +1,51 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+
+	"github.com/phnaharris/harris-blockchain-token/storage"
+)
+
+var (
+	undoPrefix = []byte("undo-")
+
+	ErrMissingUndoData = errors.New("block has no undo data")
+)
+
+// BlockUndo keeps the outputs spent by a block, one for every input of its
+// non-coinbase transactions in block order.
+type BlockUndo struct {
+	SpentOutputs []UTXOEntry
+}
+
+func undoKey(hash []byte) []byte {
+	return append(append([]byte{}, undoPrefix...), hash...)
+}
+
+func (undo BlockUndo) Serialize() ([]byte, error) {
+	var buffer bytes.Buffer
+	encode := gob.NewEncoder(&buffer)
+	err := encode.Encode(undo)
+	return buffer.Bytes(), err
+}
+
+func DeserializeBlockUndo(data []byte) (BlockUndo, error) {
+	var undo BlockUndo
+	decode := gob.NewDecoder(bytes.NewReader(data))
+	err := decode.Decode(&undo)
+	return undo, err
+}
+
+func (chain *Blockchain) GetBlockUndo(hash []byte) (BlockUndo, error) {
+	value, err := chain.Database.Get(undoKey(hash))
+	if err == storage.ErrNotFound {
+		return BlockUndo{}, ErrMissingUndoData
+	}
+	if err != nil {
+		return BlockUndo{}, err
+	}
+
+	return DeserializeBlockUndo(value)
+}
@@ -2,163 +2,358 @@ package blockchain
 
 import (
 	"bytes"
+	"encoding/binary"
+	"encoding/gob"
 	"encoding/hex"
+	"fmt"
 
-	"github.com/dgraph-io/badger"
+	"github.com/phnaharris/harris-blockchain-token/storage"
 )
 
 type UTXOSet struct {
 	Chain *Blockchain
 }
 
+// UTXOEntry is an unspent output stored under its outpoint.
+type UTXOEntry struct {
+	Value      int
+	PubKeyHash []byte
+	Height     int  // height of the block that created the output
+	Coinbase   bool // output of a coinbase transaction
+}
+
 var (
 	utxoPrefix = []byte("utxo-")
+	utxoTipKey = []byte("utxotip") // hash of the block the UTXO set is at
 	// prefixLength = len(utxoPrefix)
 )
 
-func (u UTXOSet) FindSpendableOutputs(pubKeyHash []byte, amount int) (int, map[string][]int) {
-	unspentOuts := make(map[string][]int) // map[txID] list index
-	accumulated := 0
-	db := u.Chain.Database
+// utxoKey is utxo-<txid><out> with the output index as 4 bytes big endian.
+func utxoKey(txID []byte, out int) []byte {
+	key := make([]byte, len(utxoPrefix)+len(txID)+4)
+	copy(key, utxoPrefix)
+	copy(key[len(utxoPrefix):], txID)
+	binary.BigEndian.PutUint32(key[len(utxoPrefix)+len(txID):], uint32(out))
+	return key
+}
 
-	err := db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-		it := txn.NewIterator(opts)
-		defer it.Close()
+func parseUTXOKey(key []byte) ([]byte, int) {
+	outpoint := bytes.TrimPrefix(key, utxoPrefix)
+	split := len(outpoint) - 4
+	return outpoint[:split], int(binary.BigEndian.Uint32(outpoint[split:]))
+}
 
-		for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
-			key := it.Item().KeyCopy(nil)
-			value, err := it.Item().ValueCopy(nil)
-			Handle(err)
+// IsMature tells if the output can be spent in a block at spendHeight. A
+// coinbase output must be buried under maturity blocks first, so a reorg
+// cannot invalidate its spends. The genesis coinbase cannot be reorganized
+// away and is always mature.
+func (e UTXOEntry) IsMature(spendHeight, maturity int) bool {
+	return !e.Coinbase || e.Height == 0 || spendHeight-e.Height >= maturity
+}
 
-			txID := hex.EncodeToString(bytes.TrimPrefix(key, utxoPrefix))
-			outs := DeserializeTxOutputs(value)
+func (e UTXOEntry) Output() TxOutput {
+	return TxOutput{e.Value, e.PubKeyHash}
+}
 
-			for outIdx, out := range outs.Outputs {
-				if out.IsLockedWithKey(pubKeyHash) && accumulated < amount {
-					accumulated += out.Value
-					unspentOuts[txID] = append(unspentOuts[txID], outIdx)
-				}
-				if accumulated >= amount {
-					// break faster
-					return nil
-				}
+func (e UTXOEntry) Serialize() ([]byte, error) {
+	var buffer bytes.Buffer
+	encode := gob.NewEncoder(&buffer)
+	err := encode.Encode(e)
+	return buffer.Bytes(), err
+}
+
+func DeserializeUTXOEntry(data []byte) (UTXOEntry, error) {
+	var entry UTXOEntry
+	decode := gob.NewDecoder(bytes.NewReader(data))
+	err := decode.Decode(&entry)
+	return entry, err
+}
+
+// entriesOf calls fn with the unspent outputs locked to pubKeyHash until it
+// returns false. The address index gives them directly when it is enabled,
+// the whole set is scanned otherwise.
+func (u UTXOSet) entriesOf(pubKeyHash []byte, fn func(txID []byte, outIdx int, entry UTXOEntry) bool) error {
+	indexed, err := u.Chain.AddrIndexEnabled()
+	if err != nil {
+		return err
+	}
+
+	if indexed {
+		keys, err := u.Chain.addressOutpoints(pubKeyHash)
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			value, err := u.Chain.Database.Get(key)
+			if err == storage.ErrNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			entry, err := DeserializeUTXOEntry(value)
+			if err != nil {
+				return err
+			}
+
+			id, outIdx := parseUTXOKey(key)
+			if !fn(id, outIdx, entry) {
+				return nil
 			}
 		}
 		return nil
+	}
+
+	var decodeErr error
+	err = u.Chain.Database.Iterate(utxoPrefix, nil, func(key, value []byte) bool {
+		entry, err := DeserializeUTXOEntry(value)
+		if err != nil {
+			decodeErr = err
+			return false
+		}
+		out := entry.Output()
+		if !out.IsLockedWithKey(pubKeyHash) {
+			return true
+		}
+		id, outIdx := parseUTXOKey(key)
+		return fn(id, outIdx, entry)
 	})
-	Handle(err)
+	if err != nil {
+		return err
+	}
 
-	return accumulated, unspentOuts
+	return decodeErr
 }
 
-func (u UTXOSet) FindUnspentTransactions(pubKeyHash []byte) []TxOutput {
+func (u UTXOSet) FindSpendableOutputs(pubKeyHash []byte, amount int) (int, map[string][]int, error) {
+	unspentOuts := make(map[string][]int) // map[txID] list index
+	accumulated := 0
+	bestHeight, err := u.Chain.GetBestHeight()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	err = u.entriesOf(pubKeyHash, func(id []byte, outIdx int, entry UTXOEntry) bool {
+		if entry.IsMature(bestHeight+1, u.Chain.Params.CoinbaseMaturity) {
+			txID := hex.EncodeToString(id)
+			accumulated += entry.Value
+			unspentOuts[txID] = append(unspentOuts[txID], outIdx)
+		}
+		// break faster
+		return accumulated < amount
+	})
+
+	return accumulated, unspentOuts, err
+}
+
+func (u UTXOSet) FindUnspentTransactions(pubKeyHash []byte) ([]TxOutput, error) {
 	var UTXOs []TxOutput
 
-	err := u.Chain.Database.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-		it := txn.NewIterator(opts)
-		defer it.Close()
+	err := u.entriesOf(pubKeyHash, func(_ []byte, _ int, entry UTXOEntry) bool {
+		UTXOs = append(UTXOs, entry.Output())
+		return true
+	})
+
+	return UTXOs, err
+}
 
-		for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
-			value, err := it.Item().ValueCopy(nil)
-			Handle(err)
+// GetBalance sums the outputs locked to pubKeyHash, coinbase outputs that
+// cannot be spent in the next block yet are counted apart.
+func (u UTXOSet) GetBalance(pubKeyHash []byte) (int, int, error) {
+	balance, immature := 0, 0
+	bestHeight, err := u.Chain.GetBestHeight()
+	if err != nil {
+		return 0, 0, err
+	}
 
-			outs := DeserializeTxOutputs(value)
-			for _, out := range outs.Outputs {
-				if out.IsLockedWithKey(pubKeyHash) {
-					UTXOs = append(UTXOs, out)
-				}
-			}
+	err = u.entriesOf(pubKeyHash, func(_ []byte, _ int, entry UTXOEntry) bool {
+		if entry.IsMature(bestHeight+1, u.Chain.Params.CoinbaseMaturity) {
+			balance += entry.Value
+		} else {
+			immature += entry.Value
 		}
-		return nil
+		return true
 	})
-	Handle(err)
 
-	return UTXOs
+	return balance, immature, err
 }
 
-func (u UTXOSet) CountTransactions() int {
+// FindEntry returns the unspent output txID:outIdx, ErrMissingInput if it is
+// not in the UTXO set.
+func (u UTXOSet) FindEntry(txID []byte, outIdx int) (UTXOEntry, error) {
+	if outIdx < 0 {
+		return UTXOEntry{}, fmt.Errorf("%w: %x:%d", ErrMissingInput, txID, outIdx)
+	}
+
+	value, err := u.Chain.Database.Get(utxoKey(txID, outIdx))
+	if err == storage.ErrNotFound {
+		return UTXOEntry{}, fmt.Errorf("%w: %x:%d", ErrMissingInput, txID, outIdx)
+	}
+	if err != nil {
+		return UTXOEntry{}, err
+	}
+
+	return DeserializeUTXOEntry(value)
+}
+
+func (u UTXOSet) FindOutput(txID []byte, outIdx int) (TxOutput, error) {
+	entry, err := u.FindEntry(txID, outIdx)
+	return entry.Output(), err
+}
+
+func (u UTXOSet) CountTransactions() (int, error) {
 	count := 0
-	err := u.Chain.Database.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-		it := txn.NewIterator(opts)
-		defer it.Close()
-		for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
+
+	// outputs of a transaction are stored next to each other
+	var lastID []byte
+	err := u.Chain.Database.Iterate(utxoPrefix, nil, func(key, _ []byte) bool {
+		id, _ := parseUTXOKey(key)
+		if !bytes.Equal(id, lastID) {
 			count++
+			lastID = id
 		}
-		return nil
+		return true
 	})
-	Handle(err)
-	return count
+
+	return count, err
 }
 
-func (u UTXOSet) Reindex() {
-	u.DeleteByPrefix(utxoPrefix)
-	utxo := u.Chain.FindUTXO()
+// Reindex rebuilds the UTXO set from the blocks of the active chain. The tip
+// of the set is removed first and written with the last outputs, a set left
+// partial by a crash is rebuilt again on startup.
+func (u UTXOSet) Reindex() error {
+	if err := u.Chain.Database.Delete(utxoTipKey); err != nil {
+		return err
+	}
+	if err := u.DeleteByPrefix(utxoPrefix); err != nil {
+		return err
+	}
+	utxo, err := u.Chain.FindUTXO()
+	if err != nil {
+		return err
+	}
 
-	err := u.Chain.Database.Update(func(txn *badger.Txn) error {
+	return u.Chain.Database.Update(func(batch storage.Batch) error {
 		for txID, outs := range utxo {
-			key, err := hex.DecodeString(txID)
-			Handle(err)
-			key = append(utxoPrefix, key...)
+			id, err := hex.DecodeString(txID)
+			if err != nil {
+				return err
+			}
 
-			err = txn.Set(key, TxOutputs{outs}.Serialize())
-			Handle(err)
+			for outIdx, entry := range outs {
+				value, err := entry.Serialize()
+				if err != nil {
+					return err
+				}
+				if err := batch.Put(utxoKey(id, outIdx), value); err != nil {
+					return err
+				}
+			}
 		}
 
-		return nil
+		return batch.Put(utxoTipKey, u.Chain.LastHash())
 	})
+}
 
-	Handle(err)
-}
-
-func (u UTXOSet) Update(block *Block) {
-	err := u.Chain.Database.Update(func(txn *badger.Txn) error {
-		for _, tx := range block.Transaction {
-			if !tx.IsCoinbase() {
-				for _, in := range tx.Inputs {
-					inID := append(utxoPrefix, in.ID...)
-					item, err := txn.Get(inID)
-					Handle(err)
-					value, err := item.ValueCopy(nil)
-					Handle(err)
-					outs := DeserializeTxOutputs(value)
-
-					updatedOutputs := TxOutputs{}
-					for outIdx, out := range outs.Outputs {
-						if outIdx != in.Out {
-							updatedOutputs.Outputs = append(updatedOutputs.Outputs, out)
-						}
-					}
-
-					if len(updatedOutputs.Outputs) == 0 {
-						err = txn.Delete(in.ID)
-						Handle(err)
-					} else {
-						err = txn.Set(inID, updatedOutputs.Serialize())
-						Handle(err)
-					}
+// Update applies the outputs a block spends and creates to the UTXO set in
+// batch, with the undo data to reverse it, and returns the undo data.
+func (u UTXOSet) Update(batch storage.Batch, block *Block) (BlockUndo, error) {
+	undo := BlockUndo{}
+
+	for _, tx := range block.Transaction {
+		if !tx.IsCoinbase() {
+			for _, in := range tx.Inputs {
+				inID := utxoKey(in.ID, in.Out)
+				value, err := batch.Get(inID)
+				if err != nil {
+					return undo, fmt.Errorf("%x:%d: %w", in.ID, in.Out, err)
+				}
+				entry, err := DeserializeUTXOEntry(value)
+				if err != nil {
+					return undo, err
+				}
+				undo.SpentOutputs = append(undo.SpentOutputs, entry)
+
+				if err := batch.Delete(inID); err != nil {
+					return undo, err
 				}
 			}
+		}
 
-			newOutputs := TxOutputs{}
-			newOutputs.Outputs = append(newOutputs.Outputs, tx.Outputs...)
+		for outIdx, out := range tx.Outputs {
+			entry := UTXOEntry{out.Value, out.PubKeyHash, block.Height, tx.IsCoinbase()}
+			value, err := entry.Serialize()
+			if err != nil {
+				return undo, err
+			}
+			if err := batch.Put(utxoKey(tx.ID, outIdx), value); err != nil {
+				return undo, err
+			}
+		}
+	}
 
-			txID := append(utxoPrefix, tx.ID...)
-			err := txn.Set(txID, newOutputs.Serialize())
-			Handle(err)
+	if err := batch.Put(utxoTipKey, block.Hash); err != nil {
+		return undo, err
+	}
+	value, err := undo.Serialize()
+	if err != nil {
+		return undo, err
+	}
+	return undo, batch.Put(undoKey(block.Hash), value)
+}
+
+// Disconnect reverses Update for the current tip block in batch using the
+// undo data written when the block was connected.
+func (u UTXOSet) Disconnect(batch storage.Batch, block *Block) error {
+	value, err := batch.Get(undoKey(block.Hash))
+	if err == storage.ErrNotFound {
+		return ErrMissingUndoData
+	}
+	if err != nil {
+		return err
+	}
+	undo, err := DeserializeBlockUndo(value)
+	if err != nil {
+		return err
+	}
+	spentIdx := len(undo.SpentOutputs)
+
+	for i := len(block.Transaction) - 1; i >= 0; i-- {
+		tx := block.Transaction[i]
+
+		for outIdx := range tx.Outputs {
+			if err := batch.Delete(utxoKey(tx.ID, outIdx)); err != nil {
+				return err
+			}
 		}
-		return nil
-	})
-	Handle(err)
+
+		if tx.IsCoinbase() {
+			continue
+		}
+
+		for j := len(tx.Inputs) - 1; j >= 0; j-- {
+			in := tx.Inputs[j]
+			spentIdx--
+
+			value, err := undo.SpentOutputs[spentIdx].Serialize()
+			if err != nil {
+				return err
+			}
+			if err := batch.Put(utxoKey(in.ID, in.Out), value); err != nil {
+				return err
+			}
+		}
+	}
+
+	return batch.Put(utxoTipKey, block.PrevHash)
 }
 
-func (u UTXOSet) DeleteByPrefix(prefix []byte) {
+func (u UTXOSet) DeleteByPrefix(prefix []byte) error {
 	deleteByKeys := func(keys [][]byte) error {
-		if err := u.Chain.Database.Update(func(txn *badger.Txn) error {
+		if err := u.Chain.Database.Update(func(batch storage.Batch) error {
 			for _, key := range keys {
-				if err := txn.Delete(key); err != nil {
+				if err := batch.Delete(key); err != nil {
 					return err
 				}
 			}
@@ -171,33 +366,32 @@ func (u UTXOSet) DeleteByPrefix(prefix []byte) {
 
 	collectMaxsize := 100000
 
-	err := u.Chain.Database.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-		opts.PrefetchValues = false
-		it := txn.NewIterator(opts)
-		defer it.Close()
-
-		keyForDeletes := make([][]byte, 0, collectMaxsize)
-		keyCollected := 0
-
-		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
-			key := it.Item().KeyCopy(nil)
-			keyForDeletes = append(keyForDeletes, key)
-			keyCollected++
-			if keyCollected == collectMaxsize {
-				err := deleteByKeys(keyForDeletes)
-				Handle(err)
-
-				keyForDeletes = make([][]byte, 0, collectMaxsize)
-				keyCollected = 0
+	keyForDeletes := make([][]byte, 0, collectMaxsize)
+	keyCollected := 0
+
+	var deleteErr error
+	err := u.Chain.Database.Iterate(prefix, nil, func(key, _ []byte) bool {
+		keyForDeletes = append(keyForDeletes, key)
+		keyCollected++
+		if keyCollected == collectMaxsize {
+			if deleteErr = deleteByKeys(keyForDeletes); deleteErr != nil {
+				return false
 			}
-		}
 
-		if keyCollected > 0 {
-			err := deleteByKeys(keyForDeletes)
-			Handle(err)
+			keyForDeletes = make([][]byte, 0, collectMaxsize)
+			keyCollected = 0
 		}
-		return nil
+		return true
 	})
-	Handle(err)
+	if err != nil {
+		return err
+	}
+	if deleteErr != nil {
+		return deleteErr
+	}
+
+	if keyCollected > 0 {
+		return deleteByKeys(keyForDeletes)
+	}
+	return nil
 }
@@ -0,0 +1,181 @@
+package blockchain_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/phnaharris/harris-blockchain-token/blockchain"
+	"github.com/phnaharris/harris-blockchain-token/chaincfg"
+	"github.com/phnaharris/harris-blockchain-token/consensus"
+	"github.com/phnaharris/harris-blockchain-token/storage"
+	"github.com/phnaharris/harris-blockchain-token/wallet"
+)
+
+// newTestChain returns a regtest chain kept in memory.
+func newTestChain(t *testing.T) *blockchain.Blockchain {
+	t.Helper()
+
+	params := chaincfg.RegTestParams
+	chain, err := blockchain.NewBlockchain(storage.NewMemory(), &params, consensus.NewProofOfWork(&params))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return chain
+}
+
+// mineBlock mines the transactions of mempool on top of the tip.
+func mineBlock(t *testing.T, chain *blockchain.Blockchain, address string, mempool []*blockchain.Transaction) *blockchain.Block {
+	t.Helper()
+
+	template, err := chain.NewBlockTemplate(mempool, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := chain.Engine.Seal(context.Background(), template.Block); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := chain.AddBlock(template.Block); err != nil {
+		t.Fatal(err)
+	}
+
+	return template.Block
+}
+
+func TestReindexSpendInSameBlock(t *testing.T) {
+	chain := newTestChain(t)
+	utxo := blockchain.UTXOSet{Chain: chain}
+
+	w, err := wallet.MakeWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := string(w.Address(chain.Params))
+
+	// the first coinbase becomes mature
+	for i := 0; i < chain.Params.CoinbaseMaturity+1; i++ {
+		mineBlock(t, chain, address, nil)
+	}
+
+	// b spends an output of a, both are mined in the same block
+	a, err := blockchain.NewTransaction(w, address, 5, 0, &utxo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &blockchain.Transaction{
+		Inputs:  []blockchain.TxInput{{ID: a.ID, Out: 0, PubKey: w.PublicKey}},
+		Outputs: []blockchain.TxOutput{{Value: 5, PubKeyHash: wallet.PublicKeyHash(w.PublicKey)}},
+	}
+	if err := b.Sign(&w.PrivateKey, map[string]blockchain.Transaction{hex.EncodeToString(a.ID): *a}); err != nil {
+		t.Fatal(err)
+	}
+	b.ID = b.Hash()
+
+	block := mineBlock(t, chain, address, []*blockchain.Transaction{a, b})
+	if len(block.Transaction) != 3 {
+		t.Fatalf("block has %d transactions, want 3", len(block.Transaction))
+	}
+
+	check := func(when string) {
+		t.Helper()
+
+		if _, err := utxo.FindEntry(a.ID, 0); !errors.Is(err, blockchain.ErrMissingInput) {
+			t.Errorf("%s: spent output a:0 gives %v, want ErrMissingInput", when, err)
+		}
+		if _, err := utxo.FindEntry(a.ID, 1); err != nil {
+			t.Errorf("%s: change a:1: %v", when, err)
+		}
+		if _, err := utxo.FindEntry(b.ID, 0); err != nil {
+			t.Errorf("%s: output b:0: %v", when, err)
+		}
+	}
+
+	check("connected")
+	if err := utxo.Reindex(); err != nil {
+		t.Fatal(err)
+	}
+	check("reindexed")
+}
+
+// utxoSnapshot returns the keys and values of the UTXO set and its tip.
+func utxoSnapshot(t *testing.T, chain *blockchain.Blockchain) map[string][]byte {
+	t.Helper()
+
+	snapshot := make(map[string][]byte)
+	err := chain.Database.Iterate([]byte("utxo"), nil, func(key, value []byte) bool {
+		snapshot[string(key)] = append([]byte{}, value...)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return snapshot
+}
+
+func TestDisconnectReversesUpdate(t *testing.T) {
+	chain := newTestChain(t)
+	utxo := blockchain.UTXOSet{Chain: chain}
+
+	w, err := wallet.MakeWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := string(w.Address(chain.Params))
+
+	for i := 0; i < chain.Params.CoinbaseMaturity+1; i++ {
+		mineBlock(t, chain, address, nil)
+	}
+
+	// b spends both outputs of a in the same block
+	a, err := blockchain.NewTransaction(w, address, 5, 0, &utxo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a.Outputs) != 2 {
+		t.Fatalf("a has %d outputs, want the payment and the change", len(a.Outputs))
+	}
+	b := &blockchain.Transaction{
+		Inputs: []blockchain.TxInput{
+			{ID: a.ID, Out: 0, PubKey: w.PublicKey},
+			{ID: a.ID, Out: 1, PubKey: w.PublicKey},
+		},
+		Outputs: []blockchain.TxOutput{{Value: a.Outputs[0].Value + a.Outputs[1].Value, PubKeyHash: wallet.PublicKeyHash(w.PublicKey)}},
+	}
+	if err := b.Sign(&w.PrivateKey, map[string]blockchain.Transaction{hex.EncodeToString(a.ID): *a}); err != nil {
+		t.Fatal(err)
+	}
+	b.ID = b.Hash()
+
+	before := utxoSnapshot(t, chain)
+	block := mineBlock(t, chain, address, []*blockchain.Transaction{a, b})
+	if len(block.Transaction) != 3 {
+		t.Fatalf("block has %d transactions, want 3", len(block.Transaction))
+	}
+	if reflect.DeepEqual(utxoSnapshot(t, chain), before) {
+		t.Fatal("connecting the block left the UTXO set as it was")
+	}
+
+	err = chain.Database.Update(func(batch storage.Batch) error {
+		return utxo.Disconnect(batch, block)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	after := utxoSnapshot(t, chain)
+	for key, value := range before {
+		if !bytes.Equal(after[key], value) {
+			t.Errorf("%q is %x after disconnecting, want %x", key, after[key], value)
+		}
+	}
+	for key := range after {
+		if _, ok := before[key]; !ok {
+			t.Errorf("%q is left after disconnecting", key)
+		}
+	}
+}
@@ -0,0 +1,353 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// medianTimeBlocks is the number of blocks whose median timestamp a new block
+// must be dated after.
+const medianTimeBlocks = 11
+
+var (
+	ErrInvalidBlockHash = errors.New("block hash does not match block header")
+	ErrBadVersion       = errors.New("block version is not supported")
+	ErrBadMerkleRoot    = errors.New("merkle root does not match block transactions")
+	ErrOrphanBlock      = errors.New("previous block is not found")
+	ErrInvalidHeight    = errors.New("block height does not follow previous block")
+	ErrBadDifficulty    = errors.New("block does not use the required difficulty")
+	ErrTimeTooOld       = errors.New("block timestamp is too old")
+	ErrTimeTooNew       = errors.New("block timestamp is too far in the future")
+	ErrNotOnTip         = errors.New("previous block is not the current tip")
+	ErrNoTransactions   = errors.New("block has no transaction")
+	ErrBlockTooBig      = errors.New("block is larger than the maximum block size")
+	ErrNoCoinbase       = errors.New("first transaction of block is not coinbase")
+	ErrMultipleCoinbase = errors.New("block has more than one coinbase")
+	ErrBadCoinbaseValue = errors.New("coinbase pays more than subsidy plus fees")
+	ErrDuplicateTx      = errors.New("block contains duplicate transaction")
+	ErrBadTxID          = errors.New("transaction ID does not match its content")
+	ErrMissingInput     = errors.New("transaction input is not in UTXO set")
+	ErrDoubleSpend      = errors.New("transaction output is spent twice in block")
+	ErrImmatureSpend    = errors.New("transaction spends immature coinbase output")
+	ErrInvalidSignature = errors.New("transaction signature is not valid")
+	ErrValueMismatch    = errors.New("transaction outputs exceed inputs")
+)
+
+// ValidateBlock runs every consensus check on a block that is going to be
+// connected on top of the current tip.
+func (chain *Blockchain) ValidateBlock(block *Block) error {
+	if err := chain.checkBlockSanity(block); err != nil {
+		return err
+	}
+
+	if !bytes.Equal(block.PrevHash, chain.LastHash()) {
+		return ErrNotOnTip
+	}
+
+	parent, err := chain.GetBlock(block.PrevHash)
+	if err != nil {
+		return ErrOrphanBlock
+	}
+
+	if err := chain.checkHeaderContext(&block.BlockHeader, &parent.BlockHeader); err != nil {
+		return err
+	}
+
+	return chain.checkBlockTransactions(block)
+}
+
+// CheckHeader checks a header on its own: version and the seal of the
+// consensus engine. It needs neither other blocks nor the transactions.
+func (chain *Blockchain) CheckHeader(header *BlockHeader, seal []byte) error {
+	if header.Version < 1 {
+		return ErrBadVersion
+	}
+
+	return chain.Engine.VerifyHeader(header, seal)
+}
+
+// ValidateHeader checks a header and its link to a stored parent.
+func (chain *Blockchain) ValidateHeader(header *BlockHeader, seal []byte) error {
+	if err := chain.CheckHeader(header, seal); err != nil {
+		return err
+	}
+
+	parent, err := chain.GetBlock(header.PrevHash)
+	if err != nil {
+		return ErrOrphanBlock
+	}
+
+	return chain.checkHeaderContext(header, &parent.BlockHeader)
+}
+
+// checkBlockSanity checks everything that does not depend on other blocks.
+func (chain *Blockchain) checkBlockSanity(block *Block) error {
+	if !bytes.Equal(block.BlockHeader.Hash(), block.Hash) {
+		return ErrInvalidBlockHash
+	}
+	if err := chain.CheckHeader(&block.BlockHeader, block.Seal); err != nil {
+		return err
+	}
+
+	if len(block.Transaction) == 0 {
+		return ErrNoTransactions
+	}
+	if len(block.Serialize()) > MaxBlockSize {
+		return ErrBlockTooBig
+	}
+	if !bytes.Equal(block.HashTransaction(), block.MerkleRoot) {
+		return ErrBadMerkleRoot
+	}
+	if !block.Transaction[0].IsCoinbase() {
+		return ErrNoCoinbase
+	}
+
+	seen := make(map[string]bool)
+	for i, tx := range block.Transaction {
+		if i > 0 && tx.IsCoinbase() {
+			return ErrMultipleCoinbase
+		}
+
+		if !bytes.Equal(tx.ID, tx.Hash()) {
+			return fmt.Errorf("%w: %x", ErrBadTxID, tx.ID)
+		}
+
+		txID := hex.EncodeToString(tx.ID)
+		if seen[txID] {
+			return fmt.Errorf("%w: %s", ErrDuplicateTx, txID)
+		}
+		seen[txID] = true
+	}
+
+	return nil
+}
+
+func (chain *Blockchain) checkHeaderContext(header, parent *BlockHeader) error {
+	if !bytes.Equal(header.PrevHash, parent.Hash()) {
+		return ErrOrphanBlock
+	}
+	if header.Height != parent.Height+1 {
+		return fmt.Errorf("%w: got %d, want %d", ErrInvalidHeight, header.Height, parent.Height+1)
+	}
+	bits, err := chain.Engine.CalcDifficulty(chain, parent)
+	if err != nil {
+		return err
+	}
+	if header.Bits != bits {
+		return fmt.Errorf("%w: got %08x, want %08x", ErrBadDifficulty, header.Bits, bits)
+	}
+	return chain.checkTimestamp(header, parent)
+}
+
+// checkTimestamp bounds the timestamps the difficulty is computed from. A
+// block is dated after the median of the blocks before it and at most
+// MaxTimeOffset ahead of the clock. The first block of a retarget interval is
+// not dated before its parent either: the time between them is measured by
+// no interval, so it could otherwise take back time claimed by the last one.
+func (chain *Blockchain) checkTimestamp(header, parent *BlockHeader) error {
+	median, err := chain.medianTimePast(parent)
+	if err != nil {
+		return err
+	}
+	if header.Timestamp <= median {
+		return fmt.Errorf("%w: %d, not after the median time %d", ErrTimeTooOld, header.Timestamp, median)
+	}
+	if chain.startsInterval(header.Height) && header.Timestamp < parent.Timestamp {
+		return fmt.Errorf("%w: %d, before the parent time %d", ErrTimeTooOld, header.Timestamp, parent.Timestamp)
+	}
+	if limit := time.Now().Unix() + int64(chain.Params.MaxTimeOffset); header.Timestamp > limit {
+		return fmt.Errorf("%w: %d, after %d", ErrTimeTooNew, header.Timestamp, limit)
+	}
+
+	return nil
+}
+
+// startsInterval tells if the block at height is the first one of a retarget
+// interval.
+func (chain *Blockchain) startsInterval(height int) bool {
+	p := chain.Params
+	return !p.NoRetargeting && p.RetargetInterval > 0 && height%p.RetargetInterval == 0
+}
+
+// medianTimePast is the median timestamp of header and the blocks before it,
+// medianTimeBlocks of them at most.
+func (chain *Blockchain) medianTimePast(header *BlockHeader) (int64, error) {
+	times := []int64{header.Timestamp}
+	prevHash := header.PrevHash
+	for len(times) < medianTimeBlocks && len(prevHash) > 0 {
+		prev, err := chain.GetBlock(prevHash)
+		if err != nil {
+			return 0, err
+		}
+		times = append(times, prev.Timestamp)
+		prevHash = prev.PrevHash
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+
+	return times[len(times)/2], nil
+}
+
+// nextTimestamp is the timestamp of a new block on top of parent: the clock,
+// moved forward if the timestamp rules need a later one.
+func (chain *Blockchain) nextTimestamp(parent *BlockHeader) (int64, error) {
+	median, err := chain.medianTimePast(parent)
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := time.Now().Unix()
+	if timestamp <= median {
+		timestamp = median + 1
+	}
+	if chain.startsInterval(parent.Height+1) && timestamp < parent.Timestamp {
+		timestamp = parent.Timestamp
+	}
+
+	return timestamp, nil
+}
+
+// blockView resolves transaction inputs against the UTXO set, which must be
+// at the parent of the block, and the transactions before them in the block.
+type blockView struct {
+	chain    *Blockchain
+	height   int
+	maxMoney int // no value or sum of values may go above it
+
+	txs   map[string]Transaction // transactions added to the block
+	spent map[string]bool        // "txid:out" spent in the block
+}
+
+func (chain *Blockchain) newBlockView(height int) *blockView {
+	return &blockView{chain, height, chain.Params.Subsidy.MaxSupply(), make(map[string]Transaction), make(map[string]bool)}
+}
+
+// addValue adds value to total, which is at most max. It fails when value is
+// negative or the sum goes above max, so that sums cannot wrap around.
+func addValue(total, value, max int) (int, bool) {
+	if value < 0 || value > max-total {
+		return 0, false
+	}
+
+	return total + value, true
+}
+
+// checkTransaction verifies a non-coinbase transaction could be the next one
+// of the block and returns its fee.
+func (v *blockView) checkTransaction(tx *Transaction) (int, error) {
+	UTXOSet := UTXOSet{v.chain}
+	txID := hex.EncodeToString(tx.ID)
+
+	prevTxs := make(map[string]Transaction)
+	spent := make(map[string]bool)
+	inValue := 0
+
+	for _, in := range tx.Inputs {
+		inID := hex.EncodeToString(in.ID)
+		outpoint := fmt.Sprintf("%s:%d", inID, in.Out)
+		if v.spent[outpoint] || spent[outpoint] {
+			return 0, fmt.Errorf("%w: %s", ErrDoubleSpend, outpoint)
+		}
+		spent[outpoint] = true
+
+		var out TxOutput
+		if prevTx, ok := v.txs[inID]; ok {
+			if in.Out < 0 || in.Out >= len(prevTx.Outputs) {
+				return 0, fmt.Errorf("%w: %s", ErrMissingInput, outpoint)
+			}
+			if prevTx.IsCoinbase() {
+				return 0, fmt.Errorf("%w: %s", ErrImmatureSpend, outpoint)
+			}
+			out = prevTx.Outputs[in.Out]
+			prevTxs[inID] = prevTx
+		} else {
+			entry, err := UTXOSet.FindEntry(in.ID, in.Out)
+			if err != nil {
+				return 0, err
+			}
+			if !entry.IsMature(v.height, v.chain.Params.CoinbaseMaturity) {
+				return 0, fmt.Errorf("%w: %s", ErrImmatureSpend, outpoint)
+			}
+			out = entry.Output()
+
+			prevTx, err := v.chain.FindTransaction(in.ID)
+			if err != nil || in.Out >= len(prevTx.Outputs) {
+				return 0, fmt.Errorf("%w: %s", ErrMissingInput, outpoint)
+			}
+			prevTxs[inID] = prevTx
+		}
+
+		if !in.UsesKey(out.PubKeyHash) {
+			return 0, fmt.Errorf("%w: tx %s", ErrInvalidSignature, txID)
+		}
+
+		var ok bool
+		if inValue, ok = addValue(inValue, out.Value, v.maxMoney); !ok {
+			return 0, fmt.Errorf("%w: tx %s spends more than the money supply", ErrValueMismatch, txID)
+		}
+	}
+
+	outValue := 0
+	for _, out := range tx.Outputs {
+		var ok bool
+		if outValue, ok = addValue(outValue, out.Value, v.maxMoney); !ok {
+			return 0, fmt.Errorf("%w: tx %s pays a value out of range", ErrValueMismatch, txID)
+		}
+	}
+	if inValue < outValue {
+		return 0, fmt.Errorf("%w: tx %s", ErrValueMismatch, txID)
+	}
+
+	if !tx.Verify(prevTxs) {
+		return 0, fmt.Errorf("%w: tx %s", ErrInvalidSignature, txID)
+	}
+
+	return inValue - outValue, nil
+}
+
+// add puts a checked transaction in the block.
+func (v *blockView) add(tx *Transaction) {
+	if !tx.IsCoinbase() {
+		for _, in := range tx.Inputs {
+			v.spent[fmt.Sprintf("%x:%d", in.ID, in.Out)] = true
+		}
+	}
+	v.txs[hex.EncodeToString(tx.ID)] = *tx
+}
+
+// checkBlockTransactions verifies the block transactions against the UTXO
+// set, which must be at the block parent.
+func (chain *Blockchain) checkBlockTransactions(block *Block) error {
+	view := chain.newBlockView(block.Height)
+	fees := 0
+
+	for _, tx := range block.Transaction {
+		if !tx.IsCoinbase() {
+			fee, err := view.checkTransaction(tx)
+			if err != nil {
+				return err
+			}
+			var ok bool
+			if fees, ok = addValue(fees, fee, view.maxMoney); !ok {
+				return fmt.Errorf("%w: fees go past the money supply", ErrBadCoinbaseValue)
+			}
+		}
+		view.add(tx)
+	}
+
+	coinbaseValue := 0
+	for _, out := range block.Transaction[0].Outputs {
+		var ok bool
+		if coinbaseValue, ok = addValue(coinbaseValue, out.Value, view.maxMoney); !ok {
+			return fmt.Errorf("%w: pays a value out of range", ErrBadCoinbaseValue)
+		}
+	}
+	if limit := chain.Params.Subsidy.BlockSubsidy(block.Height) + fees; coinbaseValue > limit {
+		return fmt.Errorf("%w: got %d, want at most %d", ErrBadCoinbaseValue, coinbaseValue, limit)
+	}
+
+	return nil
+}
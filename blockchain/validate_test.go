@@ -0,0 +1,226 @@
+package blockchain_test
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/phnaharris/harris-blockchain-token/blockchain"
+	"github.com/phnaharris/harris-blockchain-token/chaincfg"
+	"github.com/phnaharris/harris-blockchain-token/consensus"
+	"github.com/phnaharris/harris-blockchain-token/storage"
+	"github.com/phnaharris/harris-blockchain-token/wallet"
+)
+
+// sealBlockAt mines a block on top of the tip dated timestamp, without adding
+// it to the chain.
+func sealBlockAt(t *testing.T, chain *blockchain.Blockchain, address string, timestamp int64) *blockchain.Block {
+	t.Helper()
+
+	template, err := chain.NewBlockTemplate(nil, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.Block.Timestamp = timestamp
+	if err := chain.Engine.Seal(context.Background(), template.Block); err != nil {
+		t.Fatal(err)
+	}
+
+	return template.Block
+}
+
+// sealBlockWith mines a block on top of the tip with txs after the template
+// transactions, without adding it to the chain.
+func sealBlockWith(t *testing.T, chain *blockchain.Blockchain, address string, txs ...*blockchain.Transaction) *blockchain.Block {
+	t.Helper()
+
+	template, err := chain.NewBlockTemplate(nil, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := template.Block
+	block.Transaction = append(block.Transaction, txs...)
+	block.MerkleRoot = block.HashTransaction()
+	if err := chain.Engine.Seal(context.Background(), block); err != nil {
+		t.Fatal(err)
+	}
+
+	return block
+}
+
+// spendTx returns a transaction of w spending output out of prev, with an
+// output to w for each value.
+func spendTx(t *testing.T, w *wallet.Wallet, prev *blockchain.Transaction, out int, values ...int) *blockchain.Transaction {
+	t.Helper()
+
+	tx := &blockchain.Transaction{
+		Inputs: []blockchain.TxInput{{ID: prev.ID, Out: out, PubKey: w.PublicKey}},
+	}
+	for _, value := range values {
+		tx.Outputs = append(tx.Outputs, blockchain.TxOutput{Value: value, PubKeyHash: wallet.PublicKeyHash(w.PublicKey)})
+	}
+	if err := tx.Sign(&w.PrivateKey, map[string]blockchain.Transaction{hex.EncodeToString(prev.ID): *prev}); err != nil {
+		t.Fatal(err)
+	}
+	tx.ID = tx.Hash()
+
+	return tx
+}
+
+func TestValueOverflow(t *testing.T) {
+	chain := newTestChain(t)
+	utxo := blockchain.UTXOSet{Chain: chain}
+
+	w, err := wallet.MakeWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := string(w.Address(chain.Params))
+
+	for i := 0; i < chain.Params.CoinbaseMaturity+1; i++ {
+		mineBlock(t, chain, address, nil)
+	}
+	a, err := blockchain.NewTransaction(w, address, 5, 0, &utxo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mineBlock(t, chain, address, []*blockchain.Transaction{a})
+
+	// the outputs add up to 2 once the sum wraps around
+	overflow := spendTx(t, w, a, 0, math.MaxInt, math.MaxInt, 4)
+
+	template, err := chain.NewBlockTemplate([]*blockchain.Transaction{overflow}, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(template.Block.Transaction) != 1 {
+		t.Errorf("template has %d transactions, want only the coinbase", len(template.Block.Transaction))
+	}
+
+	if _, err := chain.AddBlock(sealBlockWith(t, chain, address, overflow)); !errors.Is(err, blockchain.ErrValueMismatch) {
+		t.Errorf("block spending 5 coins into %d: got %v, want ErrValueMismatch", overflow.Outputs[0].Value, err)
+	}
+	if _, err := utxo.FindEntry(overflow.ID, 0); !errors.Is(err, blockchain.ErrMissingInput) {
+		t.Errorf("output of the rejected transaction gives %v, want ErrMissingInput", err)
+	}
+}
+
+// sealCoinbase mines a block on top of the tip whose coinbase pays values to
+// w, without adding it to the chain.
+func sealCoinbase(t *testing.T, chain *blockchain.Blockchain, w *wallet.Wallet, values ...int) *blockchain.Block {
+	t.Helper()
+
+	template, err := chain.NewBlockTemplate(nil, string(w.Address(chain.Params)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := template.Block
+	coinbase := block.Transaction[0]
+	coinbase.Outputs = nil
+	for _, value := range values {
+		coinbase.Outputs = append(coinbase.Outputs, blockchain.TxOutput{Value: value, PubKeyHash: wallet.PublicKeyHash(w.PublicKey)})
+	}
+	coinbase.ID = coinbase.Hash()
+	block.MerkleRoot = block.HashTransaction()
+	if err := chain.Engine.Seal(context.Background(), block); err != nil {
+		t.Fatal(err)
+	}
+
+	return block
+}
+
+func TestSupplyCap(t *testing.T) {
+	chain := newTestChain(t)
+	subsidy := chain.Params.Subsidy
+
+	// the subsidy is zero from the 63rd halving on
+	maxSupply := subsidy.MaxSupply()
+	if issued := subsidy.IssuedSupply(63 * subsidy.HalvingInterval); issued != maxSupply {
+		t.Fatalf("issued supply %d once the subsidy stops, max supply %d", issued, maxSupply)
+	}
+
+	w, err := wallet.MakeWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		values []int
+	}{
+		{"above the cap", []int{maxSupply + 1}},
+		{"wrapping around", []int{math.MaxInt, math.MaxInt, 22}},
+		{"negative", []int{subsidy.BlockSubsidy(1) + 1, -1}},
+	}
+	for _, test := range tests {
+		if _, err := chain.AddBlock(sealCoinbase(t, chain, w, test.values...)); !errors.Is(err, blockchain.ErrBadCoinbaseValue) {
+			t.Errorf("coinbase %s: got %v, want ErrBadCoinbaseValue", test.name, err)
+		}
+	}
+
+	if _, err := chain.AddBlock(sealCoinbase(t, chain, w, subsidy.BlockSubsidy(1))); err != nil {
+		t.Errorf("coinbase paying the subsidy: %v", err)
+	}
+}
+
+func TestBlockTimestamp(t *testing.T) {
+	// regtest with retargeting, the difficulty stays at its easiest
+	params := chaincfg.RegTestParams
+	params.NoRetargeting = false
+	chain, err := blockchain.NewBlockchain(storage.NewMemory(), &params, consensus.NewProofOfWork(&params))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := wallet.MakeWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := string(w.Address(chain.Params))
+
+	now := time.Now().Unix()
+	base := now - 1000
+
+	// heights 1 to 9, the last one dated ahead of the clock
+	for height := 1; height < params.RetargetInterval; height++ {
+		timestamp := base + int64(height)*10
+		if height == params.RetargetInterval-1 {
+			timestamp = now + 30
+		}
+		if _, err := chain.AddBlock(sealBlockAt(t, chain, address, timestamp)); err != nil {
+			t.Fatalf("height %d: %v", height, err)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		timestamp int64
+		want      error
+	}{
+		{"at the median time", base + 50, blockchain.ErrTimeTooOld},
+		{"first of an interval before its parent", now, blockchain.ErrTimeTooOld},
+		{"too far ahead", now + int64(params.MaxTimeOffset) + 60, blockchain.ErrTimeTooNew},
+		{"at its parent time", now + 30, nil},
+	}
+	for _, test := range tests {
+		_, err := chain.AddBlock(sealBlockAt(t, chain, address, test.timestamp))
+		if !errors.Is(err, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.want)
+		}
+	}
+
+	// the template of the next block is dated by the rules
+	template, err := chain.NewBlockTemplate(nil, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := chain.Engine.Seal(context.Background(), template.Block); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := chain.AddBlock(template.Block); err != nil {
+		t.Errorf("template block: %v", err)
+	}
+}
@@ -0,0 +1,225 @@
+// Package chaincfg defines the parameters of the networks a node can join.
+// Nodes, wallets and blocks of different networks do not mix: messages start
+// with the network magic and addresses with its version byte.
+package chaincfg
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// validatorsFile lists the addresses of the validators of a
+// proof-of-authority network, one per line, in the data directory.
+const validatorsFile = "%s/validators"
+
+var ErrUnknownNetwork = errors.New("unknown network")
+
+// Consensus engines, see package consensus.
+const (
+	PoW = "pow"
+	PoA = "poa"
+)
+
+// Genesis describes the first block of a network, every node builds the same
+// one. Its coinbase pays the subsidy at height 0 to PubKeyHash, which is all
+// zero so the coins cannot be spent.
+type Genesis struct {
+	Timestamp    int64
+	Bits         uint32
+	Nonce        uint32
+	CoinbaseData string
+	PubKeyHash   []byte
+	Hash         string // hex hash the built block must have
+}
+
+type Params struct {
+	Name        string
+	Magic       uint32 // first bytes of every network message
+	DefaultPort string
+	SeedNodes   []string // nodes the address book starts with
+	DataDir     string   // directory of the block database and wallets
+
+	AddressVersion byte // first byte of the addresses
+
+	Genesis Genesis
+
+	// Consensus rules
+	Engine             string   // PoW or PoA
+	Validators         []string // addresses signing the PoA blocks, in turn
+	InitialDifficulty  int      // leading zero bits of the genesis target
+	MinDifficulty      int      // leading zero bits of the easiest allowed target
+	RetargetInterval   int      // blocks between two difficulty adjustments
+	TargetBlockSpacing int      // expected seconds between two blocks
+	MaxRetargetFactor  int      // bound of a single adjustment, up or down
+	NoRetargeting      bool     // keep the genesis difficulty forever
+	MaxTimeOffset      int      // seconds a block timestamp may be ahead of the node clock
+
+	Subsidy          SubsidySchedule
+	CoinbaseMaturity int // blocks a coinbase output must be buried under before it is spent
+}
+
+var MainNetParams = Params{
+	Name:        "mainnet",
+	Magic:       0x48425443, // "HBTC"
+	DefaultPort: "3000",
+	SeedNodes:   []string{"localhost:3000"},
+	DataDir:     "./tmp",
+
+	AddressVersion: 0x00,
+
+	Genesis: Genesis{
+		Timestamp:    1700000000,
+		Bits:         0x1f100000,
+		Nonce:        901,
+		CoinbaseData: "First Transaction from Genesis",
+		PubKeyHash:   make([]byte, 20),
+		Hash:         "000220a27dbffa56e8408da2649662fa82ce3266442201557c4409ec65f38902",
+	},
+
+	Engine:             PoW,
+	InitialDifficulty:  12,
+	MinDifficulty:      8,
+	RetargetInterval:   10,
+	TargetBlockSpacing: 10,
+	MaxRetargetFactor:  4,
+	MaxTimeOffset:      60, // under a retarget interval, blocks dated ahead lower the difficulty once at most
+
+	Subsidy:          SubsidySchedule{Initial: 20, HalvingInterval: 210},
+	CoinbaseMaturity: 10,
+}
+
+// TestNetParams has the rules of the main network, its coins have no value.
+var TestNetParams = Params{
+	Name:        "testnet",
+	Magic:       0x48425454, // "HBTT"
+	DefaultPort: "4000",
+	SeedNodes:   []string{"localhost:4000"},
+	DataDir:     "./tmp/testnet",
+
+	AddressVersion: 0x6f,
+
+	Genesis: Genesis{
+		Timestamp:    1700000000,
+		Bits:         0x1f100000,
+		Nonce:        376,
+		CoinbaseData: "First Transaction from Testnet Genesis",
+		PubKeyHash:   make([]byte, 20),
+		Hash:         "0008cae0ea20f5be5f1df0529fada51c5ed1ef45971619d982295e2451e38c1d",
+	},
+
+	Engine:             PoW,
+	InitialDifficulty:  12,
+	MinDifficulty:      8,
+	RetargetInterval:   10,
+	TargetBlockSpacing: 10,
+	MaxRetargetFactor:  4,
+	MaxTimeOffset:      60, // under a retarget interval, blocks dated ahead lower the difficulty once at most
+
+	Subsidy:          SubsidySchedule{Initial: 20, HalvingInterval: 210},
+	CoinbaseMaturity: 10,
+}
+
+// RegTestParams is a local network for tests: blocks are found at once and
+// coinbase outputs can be spent soon.
+var RegTestParams = Params{
+	Name:        "regtest",
+	Magic:       0x48425452, // "HBTR"
+	DefaultPort: "5000",
+	SeedNodes:   []string{"localhost:5000"},
+	DataDir:     "./tmp/regtest",
+
+	AddressVersion: 0x6f,
+
+	Genesis: Genesis{
+		Timestamp:    1700000000,
+		Bits:         0x21008000,
+		Nonce:        0,
+		CoinbaseData: "First Transaction from Regtest Genesis",
+		PubKeyHash:   make([]byte, 20),
+		Hash:         "18cb4d618fc25314b8e91ba2b5f4a94f737037ee7fed3183ceac8404fd720e81",
+	},
+
+	Engine:             PoW,
+	InitialDifficulty:  1,
+	MinDifficulty:      1,
+	RetargetInterval:   10,
+	TargetBlockSpacing: 10,
+	MaxRetargetFactor:  4,
+	NoRetargeting:      true,
+	MaxTimeOffset:      2 * 60 * 60,
+
+	Subsidy:          SubsidySchedule{Initial: 20, HalvingInterval: 150},
+	CoinbaseMaturity: 2,
+}
+
+// PoANetParams is a private network whose blocks are signed by validators in
+// turn. The validators are listed in the validators file of its data
+// directory, the genesis block is the only one without a signature.
+var PoANetParams = Params{
+	Name:        "poanet",
+	Magic:       0x48425450, // "HBTP"
+	DefaultPort: "6000",
+	SeedNodes:   []string{"localhost:6000"},
+	DataDir:     "./tmp/poanet",
+
+	AddressVersion: 0x6f,
+
+	Genesis: Genesis{
+		Timestamp:    1700000000,
+		Bits:         0,
+		Nonce:        0,
+		CoinbaseData: "First Transaction from Authority Genesis",
+		PubKeyHash:   make([]byte, 20),
+		Hash:         "9416325d85848c22270be46d945a7a849c17f8110a6dce0d6c06f0228ba2aba0",
+	},
+
+	Engine:             PoA,
+	TargetBlockSpacing: 10,
+	MaxTimeOffset:      60,
+
+	Subsidy:          SubsidySchedule{Initial: 20, HalvingInterval: 210},
+	CoinbaseMaturity: 10,
+}
+
+// ByName returns the parameters of the network called name.
+func ByName(name string) (*Params, error) {
+	for _, params := range []*Params{&MainNetParams, &TestNetParams, &RegTestParams, &PoANetParams} {
+		if params.Name == name {
+			return params, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %s", ErrUnknownNetwork, name)
+}
+
+// LoadValidators reads the validators of a proof-of-authority network from
+// its validators file, unless they are set already.
+func (p *Params) LoadValidators() error {
+	if len(p.Validators) > 0 {
+		return nil
+	}
+
+	path := fmt.Sprintf(validatorsFile, p.DataDir)
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("validators of %s: %w", p.Name, err)
+	}
+	defer file.Close()
+
+	var validators []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); len(line) > 0 && !strings.HasPrefix(line, "#") {
+			validators = append(validators, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("validators of %s: %w", p.Name, err)
+	}
+	p.Validators = validators
+
+	return nil
+}
@@ -0,0 +1,49 @@
+package chaincfg
+
+// SubsidySchedule is the block reward of a network: Initial coins for the
+// first HalvingInterval blocks, then half as much after every interval until
+// it reaches zero, which caps the money supply.
+type SubsidySchedule struct {
+	Initial         int
+	HalvingInterval int
+}
+
+func (s SubsidySchedule) BlockSubsidy(height int) int {
+	halvings := height / s.HalvingInterval
+	if halvings >= 63 {
+		return 0
+	}
+
+	return s.Initial >> uint(halvings)
+}
+
+// IssuedSupply is the sum of the subsidies of the blocks from the genesis up
+// to height, fees only move existing coins.
+func (s SubsidySchedule) IssuedSupply(height int) int {
+	supply := 0
+
+	for start := 0; start <= height; start += s.HalvingInterval {
+		subsidy := s.BlockSubsidy(start)
+		if subsidy == 0 {
+			break
+		}
+
+		blocks := s.HalvingInterval
+		if start+blocks > height+1 {
+			blocks = height + 1 - start
+		}
+		supply += blocks * subsidy
+	}
+
+	return supply
+}
+
+// MaxSupply is the supply once the subsidy has dropped to zero.
+func (s SubsidySchedule) MaxSupply() int {
+	supply := 0
+	for halvings := 0; halvings < 63 && s.Initial>>uint(halvings) > 0; halvings++ {
+		supply += s.HalvingInterval * (s.Initial >> uint(halvings))
+	}
+
+	return supply
+}
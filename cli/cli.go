@@ -1,20 +1,29 @@
 package cli
 
 import (
+	"context"
+	"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
-	"log"
 	"os"
-	"runtime"
 	"strconv"
+	"time"
 
 	"github.com/phnaharris/harris-blockchain-token/blockchain"
+	"github.com/phnaharris/harris-blockchain-token/chaincfg"
+	"github.com/phnaharris/harris-blockchain-token/consensus"
 	"github.com/phnaharris/harris-blockchain-token/network"
 	"github.com/phnaharris/harris-blockchain-token/wallet"
 )
 
-type CommandLine struct{}
+// ErrUsage is returned when the command line is wrong, the usage of the
+// command has been printed.
+var ErrUsage = errors.New("wrong usage")
+
+type CommandLine struct {
+	params *chaincfg.Params // network the commands run on
+}
 
 type Command struct {
 	fullCommand string
@@ -24,263 +33,815 @@ type Command struct {
 func (cli *CommandLine) printUsage() {
 	commands := []Command{}
 	commands = append(commands, Command{"getbalance -address ADDRESS", "get the balance for an address"})
-	commands = append(commands, Command{"createblockchain -address ADDRESS", "creates a blockchain and sends genesis reward to address"})
+	commands = append(commands, Command{"createblockchain -txindex -addrindex", "creates the blockchain of the network from its genesis block, -txindex=false leaves out the transaction index, -addrindex keeps the address index"})
 	commands = append(commands, Command{"printchain", "Prints the blocks in the chain"})
-	commands = append(commands, Command{"send -from FROM -to TO -amount AMOUNT -mine", "Send amount of coins. Then -mine flag is set, mine off of this node"})
+	commands = append(commands, Command{"getblock -height HEIGHT", "Prints the block of the chain at HEIGHT"})
+	commands = append(commands, Command{"send -from FROM -to TO -amount AMOUNT -fee FEE -mine", "Send amount of coins and pay fee to the miner. Then -mine flag is set, mine off of this node"})
 	commands = append(commands, Command{"createwallet", "Creates a new Wallet"})
 	commands = append(commands, Command{"listaddresses", "Lists the addresses in our wallet file"})
 	commands = append(commands, Command{"reindexutxo", "Rebuilds the UTXO set"})
+	commands = append(commands, Command{"reindextx -disable", "Rebuilds the transaction index, -disable deletes it"})
+	commands = append(commands, Command{"gettransaction -id TXID", "Prints a transaction of the chain and its block"})
+	commands = append(commands, Command{"reindexaddr -disable", "Rebuilds the address index, -disable deletes it"})
+	commands = append(commands, Command{"getaddresshistory -address ADDRESS", "Prints the transactions of the chain paying to or spending from ADDRESS"})
+	commands = append(commands, Command{"getsupply -height HEIGHT", "Prints the coins issued up to HEIGHT, the best height by default"})
 	commands = append(commands, Command{"startnode -miner ADDRESS", "Start a node with ID specified in NODE_ID env. var. -miner enables mining"})
+	commands = append(commands, Command{"mine -address ADDRESS -rpc HOST:PORT", "Mine blocks for the node NODE_ID, or the node at -rpc, and send rewards to ADDRESS"})
+	commands = append(commands, Command{"getpeerinfo -rpc HOST:PORT", "Prints the peers of the node NODE_ID, or the node at -rpc"})
+	commands = append(commands, Command{"addnode -address HOST:PORT -rpc HOST:PORT", "Connects the node to the node at -address and keeps it connected"})
+	commands = append(commands, Command{"disconnectnode -address HOST:PORT -rpc HOST:PORT", "Disconnects the node from the node at -address and forgets it"})
 
-	fmt.Println("Usage:")
+	fmt.Println("Usage: every command takes -network mainnet|testnet|regtest|poanet, mainnet by default")
 	for _, command := range commands {
 		fmt.Printf("%4s %-55s %s\n", "", command.fullCommand, command.detail)
 	}
 }
 
-func (cli *CommandLine) validateArgs() {
+func (cli *CommandLine) validateArgs() error {
 	if len(os.Args) < 2 {
 		cli.printUsage()
-		runtime.Goexit()
+		return ErrUsage
+	}
+	return nil
+}
+
+// engine returns the consensus engine of the node. Blocks are signed with
+// the wallet of signer, which a proof-of-authority node must have. The
+// validators of a proof-of-authority network are read from its data
+// directory.
+func (cli *CommandLine) engine(nodeID, signer string) (blockchain.Engine, error) {
+	if cli.params.Engine == chaincfg.PoA {
+		if err := cli.params.LoadValidators(); err != nil {
+			return nil, err
+		}
+	}
+
+	var w *wallet.Wallet
+	if len(signer) > 0 {
+		wallets, err := wallet.CreateWallets(nodeID, cli.params)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		w = wallets.Wallets[signer]
+		if w == nil && cli.params.Engine == chaincfg.PoA {
+			return nil, fmt.Errorf("signer: %w: %s", wallet.ErrUnknownWallet, signer)
+		}
+	}
+
+	return consensus.New(cli.params, w)
+}
+
+// continueBlockchain opens the chain of the node to read or extend it.
+func (cli *CommandLine) continueBlockchain(nodeID string) (*blockchain.Blockchain, error) {
+	engine, err := cli.engine(nodeID, "")
+	if err != nil {
+		return nil, err
 	}
+
+	return blockchain.ContinueBlockchain(nodeID, cli.params, engine)
+}
+
+// pubKeyHash returns the public key hash of an address of the network.
+func (cli *CommandLine) pubKeyHash(address string) ([]byte, error) {
+	if !wallet.ValidateAddress([]byte(address), cli.params) {
+		return nil, fmt.Errorf("%w: %s", wallet.ErrInvalidAddress, address)
+	}
+
+	pubKeyHash, err := wallet.Base58Decode([]byte(address))
+	if err != nil {
+		return nil, err
+	}
+
+	return pubKeyHash[1 : len(pubKeyHash)-wallet.ChecksumLength], nil
 }
 
-func (cli *CommandLine) StartNode(nodeID, minerAddress string) {
+func (cli *CommandLine) StartNode(nodeID, minerAddress string) error {
 	fmt.Printf("Starting node %s.\n", nodeID)
 	if len(minerAddress) > 0 {
-		if wallet.ValidateAddress([]byte(minerAddress)) {
-			fmt.Printf("Mining mode is on. Address to receive rewards: %s.\n", minerAddress)
-		} else {
-			Handle(errors.New("wrong miner address"))
+		if !wallet.ValidateAddress([]byte(minerAddress), cli.params) {
+			return fmt.Errorf("wrong miner address: %w", wallet.ErrInvalidAddress)
+		}
+		fmt.Printf("Mining mode is on. Address to receive rewards: %s.\n", minerAddress)
+	}
+
+	engine, err := cli.engine(nodeID, minerAddress)
+	if err != nil {
+		return err
+	}
+
+	return network.StartServer(nodeID, minerAddress, engine)
+}
+
+// mine gets block templates from a node, mines them and submits the blocks.
+// A template is mined for TargetBlockSpacing at most, then a new one picks up
+// the transactions and blocks the node received meanwhile.
+func (cli *CommandLine) mine(address, rpcAddress, nodeID string) error {
+	if !wallet.ValidateAddress([]byte(address), cli.params) {
+		return fmt.Errorf("%w: %s", wallet.ErrInvalidAddress, address)
+	}
+
+	client, err := network.DialRPC(rpcAddress)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	engine, err := cli.engine(nodeID, address)
+	if err != nil {
+		return err
+	}
+
+	for {
+		block, template, err := client.GetBlockTemplate(address)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Mining block %d with %d transactions, reward %d.\n", block.Height, len(block.Transaction), template.Subsidy+template.Fees)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cli.params.TargetBlockSpacing)*time.Second)
+		err = engine.Seal(ctx, block)
+		cancel()
+		if errors.Is(err, context.DeadlineExceeded) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		reply, err := client.SubmitBlock(block)
+		if err != nil {
+			fmt.Printf("Block was rejected: %s.\n", err)
+			continue
 		}
+		fmt.Printf("Submitted block %d: %x.\n", reply.Height, reply.Hash)
+	}
+}
+
+func (cli *CommandLine) getPeerInfo(rpcAddress string) error {
+	client, err := network.DialRPC(rpcAddress)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	peers, err := client.GetPeerInfo()
+	if err != nil {
+		return err
+	}
+
+	for _, p := range peers {
+		direction := "outbound"
+		if p.Inbound {
+			direction = "inbound"
+		}
+		fmt.Printf("%s %s\n", p.Addr, direction)
+		fmt.Printf("\tConnected: %s\n", p.ConnectedAt.Format(time.RFC3339))
+		fmt.Printf("\tProtocol: %d\n", p.ProtocolVersion)
+		fmt.Printf("\tUser agent: %s\n", p.UserAgent)
+		fmt.Printf("\tServices: %d\n", p.Services)
+		fmt.Printf("\tStart height: %d\n", p.StartHeight)
+	}
+	fmt.Printf("%d peers.\n", len(peers))
+
+	return nil
+}
+
+func (cli *CommandLine) addNode(address, rpcAddress string) error {
+	client, err := network.DialRPC(rpcAddress)
+	if err != nil {
+		return err
 	}
-	network.StartServer(nodeID, minerAddress)
+	defer client.Close()
+
+	if err := client.AddNode(address); err != nil {
+		return err
+	}
+	fmt.Printf("Connected to %s.\n", address)
+
+	return nil
 }
 
-func (cli *CommandLine) reindexUTXO(nodeID string) {
-	chain := blockchain.ContinueBlockchain(nodeID)
+func (cli *CommandLine) disconnectNode(address, rpcAddress string) error {
+	client, err := network.DialRPC(rpcAddress)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if err := client.DisconnectNode(address); err != nil {
+		return err
+	}
+	fmt.Printf("Disconnected from %s.\n", address)
+
+	return nil
+}
+
+func (cli *CommandLine) reindexUTXO(nodeID string) error {
+	chain, err := cli.continueBlockchain(nodeID)
+	if err != nil {
+		return err
+	}
 	defer chain.Database.Close()
+
 	UTXOSet := blockchain.UTXOSet{Chain: chain}
-	UTXOSet.Reindex()
+	if err := UTXOSet.Reindex(); err != nil {
+		return err
+	}
 
-	count := UTXOSet.CountTransactions()
+	count, err := UTXOSet.CountTransactions()
+	if err != nil {
+		return err
+	}
 	fmt.Printf("Done! There are %d transactions in the UTXO set.\n", count)
+
+	return nil
+}
+
+func (cli *CommandLine) reindexTx(nodeID string, disable bool) error {
+	chain, err := cli.continueBlockchain(nodeID)
+	if err != nil {
+		return err
+	}
+	defer chain.Database.Close()
+
+	if disable {
+		if err := chain.DropTxIndex(); err != nil {
+			return err
+		}
+		fmt.Println("Done! The transaction index is deleted.")
+		return nil
+	}
+
+	count, err := chain.ReindexTransactions()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Done! There are %d transactions in the index.\n", count)
+
+	return nil
+}
+
+func (cli *CommandLine) getTransaction(txID, nodeID string) error {
+	id, err := hex.DecodeString(txID)
+	if err != nil {
+		return fmt.Errorf("transaction ID %q is not hex: %w", txID, err)
+	}
+
+	chain, err := cli.continueBlockchain(nodeID)
+	if err != nil {
+		return err
+	}
+	defer chain.Database.Close()
+
+	tx, block, err := chain.GetTransaction(id)
+	if err != nil {
+		return err
+	}
+	bestHeight, err := chain.GetBestHeight()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Block: %x.\n", block.Hash)
+	fmt.Printf("Height: %d, confirmations: %d.\n", block.Height, bestHeight-block.Height+1)
+	fmt.Println(tx)
+
+	return nil
+}
+
+func (cli *CommandLine) reindexAddr(nodeID string, disable bool) error {
+	chain, err := cli.continueBlockchain(nodeID)
+	if err != nil {
+		return err
+	}
+	defer chain.Database.Close()
+
+	if disable {
+		if err := chain.DropAddrIndex(); err != nil {
+			return err
+		}
+		fmt.Println("Done! The address index is deleted.")
+		return nil
+	}
+
+	count, err := chain.ReindexAddresses()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Done! There are %d transactions in the address index.\n", count)
+
+	return nil
+}
+
+func (cli *CommandLine) getAddressHistory(address, nodeID string) error {
+	pubKeyHash, err := cli.pubKeyHash(address)
+	if err != nil {
+		return err
+	}
+
+	chain, err := cli.continueBlockchain(nodeID)
+	if err != nil {
+		return err
+	}
+	defer chain.Database.Close()
+
+	refs, err := chain.GetAddressHistory(pubKeyHash)
+	if err != nil {
+		return err
+	}
+	bestHeight, err := chain.GetBestHeight()
+	if err != nil {
+		return err
+	}
+
+	for _, ref := range refs {
+		fmt.Printf("Transaction: %x.\n", ref.TxID)
+		fmt.Printf("Block: %x.\n", ref.BlockHash)
+		fmt.Printf("Height: %d, confirmations: %d.\n", ref.Height, bestHeight-ref.Height+1)
+		fmt.Printf("Received: %d, sent: %d.\n", ref.Received, ref.Sent)
+		fmt.Println()
+	}
+	fmt.Printf("%d transactions for %s.\n", len(refs), address)
+
+	return nil
+}
+
+func (cli *CommandLine) getSupply(height int, nodeID string) error {
+	if height < 0 {
+		chain, err := cli.continueBlockchain(nodeID)
+		if err != nil {
+			return err
+		}
+		height, err = chain.GetBestHeight()
+		chain.Database.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Block subsidy at height %d: %d.\n", height, cli.params.Subsidy.BlockSubsidy(height))
+	fmt.Printf("Issued supply at height %d: %d.\n", height, cli.params.Subsidy.IssuedSupply(height))
+	fmt.Printf("Maximum supply: %d.\n", cli.params.Subsidy.MaxSupply())
+
+	return nil
 }
 
-func (cli *CommandLine) listAddresses(nodeID string) {
-	wallets, _ := wallet.CreateWallets(nodeID)
+func (cli *CommandLine) listAddresses(nodeID string) error {
+	wallets, err := wallet.CreateWallets(nodeID, cli.params)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
 	addresses := wallets.GetAllAddresses()
 
 	for _, address := range addresses {
 		fmt.Println(address)
 	}
+
+	return nil
 }
 
-func (cli *CommandLine) createWallet(nodeID string) {
-	wallets, _ := wallet.CreateWallets(nodeID)
-	address := wallets.AddWallet()
-	wallets.SaveFile(nodeID)
+func (cli *CommandLine) createWallet(nodeID string) error {
+	wallets, err := wallet.CreateWallets(nodeID, cli.params)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	address, err := wallets.AddWallet()
+	if err != nil {
+		return err
+	}
+	if err := wallets.SaveFile(nodeID); err != nil {
+		return err
+	}
 	fmt.Printf("New address is %s.\n", address)
+
+	return nil
 }
 
-func (cli *CommandLine) printChain(nodeID string) {
-	chain := blockchain.ContinueBlockchain(nodeID)
+func (cli *CommandLine) printChain(nodeID string) error {
+	chain, err := cli.continueBlockchain(nodeID)
+	if err != nil {
+		return err
+	}
 	defer chain.Database.Close()
 
 	iter := chain.Iterator()
 	for {
-		block := iter.Next()
-
-		fmt.Printf("Hash: %x.\n", block.Hash)
-		fmt.Printf("Prev hash: %x.\n", block.PrevHash)
-		pow := blockchain.NewProof(block)
-		fmt.Printf("PoW: %x.\n", strconv.FormatBool(pow.Validate()))
-
-		for _, tx := range block.Transaction {
-			fmt.Println(tx)
+		block, err := iter.Next()
+		if err != nil {
+			return err
 		}
-		fmt.Println()
+		printBlock(chain, block)
 
 		if len(block.PrevHash) == 0 {
-			break
+			return nil
 		}
 	}
 }
 
-func (cli *CommandLine) createBlockchain(address, nodeID string) {
-	if !wallet.ValidateAddress([]byte(address)) {
-		Handle(errors.New("address is not valid"))
+func (cli *CommandLine) getBlock(height int, nodeID string) error {
+	chain, err := cli.continueBlockchain(nodeID)
+	if err != nil {
+		return err
 	}
-	chain := blockchain.InitBlockchain(address, nodeID)
 	defer chain.Database.Close()
 
-	UTXOSet := blockchain.UTXOSet{Chain: chain}
-	UTXOSet.Reindex()
+	block, err := chain.GetBlockByHeight(height)
+	if err != nil {
+		return err
+	}
+	printBlock(chain, &block)
+
+	return nil
+}
+
+func printBlock(chain *blockchain.Blockchain, block *blockchain.Block) {
+	fmt.Printf("Hash: %x.\n", block.Hash)
+	fmt.Printf("Prev hash: %x.\n", block.PrevHash)
+	fmt.Printf("Height: %d, bits: %08x.\n", block.Height, block.Bits)
+	valid := chain.CheckHeader(&block.BlockHeader, block.Seal) == nil
+	fmt.Printf("Seal: %s.\n", strconv.FormatBool(valid))
+
+	for _, tx := range block.Transaction {
+		fmt.Println(tx)
+	}
+	fmt.Println()
+}
+
+func (cli *CommandLine) createBlockchain(nodeID string, txIndex, addrIndex bool) error {
+	engine, err := cli.engine(nodeID, "")
+	if err != nil {
+		return err
+	}
+	chain, err := blockchain.InitBlockchain(nodeID, cli.params, engine)
+	if err != nil {
+		return err
+	}
+	defer chain.Database.Close()
+
+	if txIndex {
+		if _, err := chain.ReindexTransactions(); err != nil {
+			return err
+		}
+	}
+	if addrIndex {
+		if _, err := chain.ReindexAddresses(); err != nil {
+			return err
+		}
+	}
 
 	fmt.Println("Create new blockchain finished!")
+
+	return nil
 }
 
-func (cli *CommandLine) getBalance(address, nodeID string) {
-	if !wallet.ValidateAddress([]byte(address)) {
-		Handle(errors.New("address is not valid"))
+func (cli *CommandLine) getBalance(address, nodeID string) error {
+	pubKeyHash, err := cli.pubKeyHash(address)
+	if err != nil {
+		return err
 	}
 
-	chain := blockchain.ContinueBlockchain(nodeID)
+	chain, err := cli.continueBlockchain(nodeID)
+	if err != nil {
+		return err
+	}
 	UTXOSet := blockchain.UTXOSet{Chain: chain}
 	defer chain.Database.Close()
 
-	balance := 0
-	pubKeyHash := wallet.Base58Decode([]byte(address))
-	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-wallet.ChecksumLength]
-	UTXOs := UTXOSet.FindUnspentTransactions(pubKeyHash)
-
-	for _, out := range UTXOs {
-		balance += out.Value
+	balance, immature, err := UTXOSet.GetBalance(pubKeyHash)
+	if err != nil {
+		return err
 	}
 
 	fmt.Printf("Balance of %s: %d.\n", address, balance)
+	if immature > 0 {
+		fmt.Printf("Immature coinbase rewards: %d.\n", immature)
+	}
+
+	return nil
 }
 
-func (cli *CommandLine) send(from, to string, amount int, nodeID string, isMineNow bool) {
+func (cli *CommandLine) send(from, to string, amount, fee int, nodeID string, isMineNow bool) error {
 	fmt.Println("send 0")
-	if !wallet.ValidateAddress([]byte(from)) || !wallet.ValidateAddress([]byte(to)) {
-		Handle(errors.New("address is not valid"))
+	if !wallet.ValidateAddress([]byte(from), cli.params) || !wallet.ValidateAddress([]byte(to), cli.params) {
+		return wallet.ErrInvalidAddress
 	}
 	fmt.Println("send 1")
 
-	chain := blockchain.ContinueBlockchain(nodeID)
+	chain, err := cli.continueBlockchain(nodeID)
+	if err != nil {
+		return err
+	}
 	defer chain.Database.Close()
 	fmt.Println("send 2")
 	UTXOSet := blockchain.UTXOSet{Chain: chain}
-	UTXOSet.Reindex()
 	fmt.Println("send 3")
-	wallets, err := wallet.CreateWallets(nodeID)
+	wallets, err := wallet.CreateWallets(nodeID, cli.params)
+	if err != nil {
+		return err
+	}
+	wallet, err := wallets.GetWallet(from)
 	if err != nil {
-		fmt.Println("send", err)
-		log.Panic(err)
+		return err
 	}
-	wallet := wallets.GetWallet(from)
 
 	fmt.Println("send 4")
 
-	tx := blockchain.NewTransaction(&wallet, to, amount, &UTXOSet)
+	tx, err := blockchain.NewTransaction(&wallet, to, amount, fee, &UTXOSet)
+	if err != nil {
+		return err
+	}
 	if isMineNow {
 		fmt.Println("send 5")
-		cbTx := blockchain.CoinbaseTx(from, "")
+		bestHeight, err := chain.GetBestHeight()
+		if err != nil {
+			return err
+		}
+		subsidy := cli.params.Subsidy.BlockSubsidy(bestHeight + 1)
+		cbTx, err := blockchain.CoinbaseTx(from, "", subsidy+fee)
+		if err != nil {
+			return err
+		}
 		txs := []*blockchain.Transaction{cbTx, tx}
-		block := chain.MineBlock(txs)
-		UTXOSet.Update(block)
+		if _, err := chain.MineBlock(txs); err != nil {
+			return err
+		}
 		fmt.Println("send 6")
 	} else {
-		network.SendTx(network.KnownNodes[0], tx)
+		if err := network.LoadAddressBook(nodeID); err != nil {
+			return err
+		}
+		// the transaction is queued, wait until it is written
+		defer network.DisconnectPeers()
+		if err := network.SubmitTx(tx); err != nil {
+			return err
+		}
 		fmt.Println("Send tx.")
 	}
 
 	fmt.Println("Success!")
-}
 
-func (cli *CommandLine) Run() {
-	cli.validateArgs()
+	return nil
+}
 
-	nodeID := os.Getenv("NODE_ID")
-	if len(nodeID) == 0 {
-		fmt.Printf("NODE_ID env is not available!")
-		runtime.Goexit()
+func (cli *CommandLine) Run() error {
+	if err := cli.validateArgs(); err != nil {
+		return err
 	}
 
 	getBalanceCmd := flag.NewFlagSet("getbalance", flag.ExitOnError)
 	createBlockchainCmd := flag.NewFlagSet("createblockchain", flag.ExitOnError)
 	printChainCmd := flag.NewFlagSet("printchain", flag.ExitOnError)
+	getBlockCmd := flag.NewFlagSet("getblock", flag.ExitOnError)
 	sendCmd := flag.NewFlagSet("send", flag.ExitOnError)
 	createWalletCmd := flag.NewFlagSet("createwallet", flag.ExitOnError)
 	listAddressesCmd := flag.NewFlagSet("listaddresses", flag.ExitOnError)
 	reindexUTXOCmd := flag.NewFlagSet("reindexutxo", flag.ExitOnError)
+	getSupplyCmd := flag.NewFlagSet("getsupply", flag.ExitOnError)
+	reindexTxCmd := flag.NewFlagSet("reindextx", flag.ExitOnError)
+	getTransactionCmd := flag.NewFlagSet("gettransaction", flag.ExitOnError)
+	reindexAddrCmd := flag.NewFlagSet("reindexaddr", flag.ExitOnError)
+	getAddressHistoryCmd := flag.NewFlagSet("getaddresshistory", flag.ExitOnError)
 	startNodeCmd := flag.NewFlagSet("startnode", flag.ExitOnError)
+	mineCmd := flag.NewFlagSet("mine", flag.ExitOnError)
+	getPeerInfoCmd := flag.NewFlagSet("getpeerinfo", flag.ExitOnError)
+	addNodeCmd := flag.NewFlagSet("addnode", flag.ExitOnError)
+	disconnectNodeCmd := flag.NewFlagSet("disconnectnode", flag.ExitOnError)
 
 	getBalanceAddress := getBalanceCmd.String("address", "", "The address to get balance for.")
-	createBlockchainAddress := createBlockchainCmd.String("address", "", "The address to send genesis block reward to.")
+	getBlockHeight := getBlockCmd.Int("height", -1, "Height of the block")
+	createBlockchainTxIndex := createBlockchainCmd.Bool("txindex", true, "Keep a transaction index")
+	reindexTxDisable := reindexTxCmd.Bool("disable", false, "Delete the transaction index")
+	createBlockchainAddrIndex := createBlockchainCmd.Bool("addrindex", false, "Keep an address index")
+	getTransactionID := getTransactionCmd.String("id", "", "ID of the transaction in hex")
+	reindexAddrDisable := reindexAddrCmd.Bool("disable", false, "Delete the address index")
+	getAddressHistoryAddress := getAddressHistoryCmd.String("address", "", "The address to get the history of")
 	sendFrom := sendCmd.String("from", "", "Source wallet address")
 	sendTo := sendCmd.String("to", "", "Destination wallet address")
 	sendAmount := sendCmd.Int("amount", 0, "Amount to send")
+	sendFee := sendCmd.Int("fee", 0, "Fee paid to the miner")
 	sendMine := sendCmd.Bool("mine", false, "Mine immediately on the same node")
+	getSupplyHeight := getSupplyCmd.Int("height", -1, "Height to get the supply at")
 	startNodeMiner := startNodeCmd.String("miner", "", "Enable mining mode and send reward to ADDRESS")
+	mineAddress := mineCmd.String("address", "", "The address to send block rewards to")
+	mineRPC := mineCmd.String("rpc", "", "RPC address of the node, the one of NODE_ID by default")
+	getPeerInfoRPC := getPeerInfoCmd.String("rpc", "", "RPC address of the node, the one of NODE_ID by default")
+	addNodeAddress := addNodeCmd.String("address", "", "Address of the node to connect to")
+	addNodeRPC := addNodeCmd.String("rpc", "", "RPC address of the node, the one of NODE_ID by default")
+	disconnectNodeAddress := disconnectNodeCmd.String("address", "", "Address of the node to disconnect from")
+	disconnectNodeRPC := disconnectNodeCmd.String("rpc", "", "RPC address of the node, the one of NODE_ID by default")
+
+	var networkName string
+	for _, cmd := range []*flag.FlagSet{getBalanceCmd, createBlockchainCmd, printChainCmd, getBlockCmd, sendCmd, createWalletCmd,
+		listAddressesCmd, reindexUTXOCmd, reindexTxCmd, getTransactionCmd,
+		reindexAddrCmd, getAddressHistoryCmd, getSupplyCmd, startNodeCmd, mineCmd,
+		getPeerInfoCmd, addNodeCmd, disconnectNodeCmd} {
+		cmd.StringVar(&networkName, "network", chaincfg.MainNetParams.Name, "Network to use: mainnet, testnet, regtest or poanet")
+	}
 
 	switch os.Args[1] {
 
 	case "getbalance":
 		err := getBalanceCmd.Parse(os.Args[2:])
-		Handle(err)
+		if err != nil {
+			return err
+		}
 	case "createblockchain":
 		err := createBlockchainCmd.Parse(os.Args[2:])
-		Handle(err)
+		if err != nil {
+			return err
+		}
 	case "printchain":
 		err := printChainCmd.Parse(os.Args[2:])
-		Handle(err)
+		if err != nil {
+			return err
+		}
+	case "getblock":
+		err := getBlockCmd.Parse(os.Args[2:])
+		if err != nil {
+			return err
+		}
 	case "send":
 		err := sendCmd.Parse(os.Args[2:])
-		Handle(err)
+		if err != nil {
+			return err
+		}
 	case "createwallet":
 		err := createWalletCmd.Parse(os.Args[2:])
-		Handle(err)
+		if err != nil {
+			return err
+		}
 	case "listaddresses":
 		err := listAddressesCmd.Parse(os.Args[2:])
-		Handle(err)
+		if err != nil {
+			return err
+		}
 	case "reindexutxo":
 		err := reindexUTXOCmd.Parse(os.Args[2:])
-		Handle(err)
+		if err != nil {
+			return err
+		}
+	case "reindextx":
+		err := reindexTxCmd.Parse(os.Args[2:])
+		if err != nil {
+			return err
+		}
+	case "gettransaction":
+		err := getTransactionCmd.Parse(os.Args[2:])
+		if err != nil {
+			return err
+		}
+	case "reindexaddr":
+		err := reindexAddrCmd.Parse(os.Args[2:])
+		if err != nil {
+			return err
+		}
+	case "getaddresshistory":
+		err := getAddressHistoryCmd.Parse(os.Args[2:])
+		if err != nil {
+			return err
+		}
+	case "getsupply":
+		err := getSupplyCmd.Parse(os.Args[2:])
+		if err != nil {
+			return err
+		}
 	case "startnode":
 		err := startNodeCmd.Parse(os.Args[2:])
-		Handle(err)
+		if err != nil {
+			return err
+		}
+	case "mine":
+		err := mineCmd.Parse(os.Args[2:])
+		if err != nil {
+			return err
+		}
+	case "getpeerinfo":
+		err := getPeerInfoCmd.Parse(os.Args[2:])
+		if err != nil {
+			return err
+		}
+	case "addnode":
+		err := addNodeCmd.Parse(os.Args[2:])
+		if err != nil {
+			return err
+		}
+	case "disconnectnode":
+		err := disconnectNodeCmd.Parse(os.Args[2:])
+		if err != nil {
+			return err
+		}
 	default:
 		cli.printUsage()
-		runtime.Goexit()
+		return ErrUsage
+	}
+
+	params, err := chaincfg.ByName(networkName)
+	if err != nil {
+		return err
 	}
+	cli.params = params
+	network.SetParams(params)
 
-	if getBalanceCmd.Parsed() {
+	// NODE_ID is the port of the node, the network default one if not set
+	nodeID := os.Getenv("NODE_ID")
+	if len(nodeID) == 0 {
+		nodeID = params.DefaultPort
+	}
+
+	switch {
+	case getBalanceCmd.Parsed():
 		if len(*getBalanceAddress) == 0 {
 			getBalanceCmd.Usage()
-			runtime.Goexit()
+			return ErrUsage
 		}
-		cli.getBalance(*getBalanceAddress, nodeID)
-	}
-	if createBlockchainCmd.Parsed() {
-		if len(*createBlockchainAddress) == 0 {
-			createBlockchainCmd.Usage()
-			runtime.Goexit()
+		return cli.getBalance(*getBalanceAddress, nodeID)
+	case createBlockchainCmd.Parsed():
+		return cli.createBlockchain(nodeID, *createBlockchainTxIndex, *createBlockchainAddrIndex)
+	case printChainCmd.Parsed():
+		return cli.printChain(nodeID)
+	case getBlockCmd.Parsed():
+		if *getBlockHeight < 0 {
+			getBlockCmd.Usage()
+			return ErrUsage
 		}
-		cli.createBlockchain(*createBlockchainAddress, nodeID)
-	}
-	if printChainCmd.Parsed() {
-		cli.printChain(nodeID)
-	}
-	if sendCmd.Parsed() {
-		if len(*sendFrom) == 0 || len(*sendTo) == 0 || *sendAmount < 0 {
+		return cli.getBlock(*getBlockHeight, nodeID)
+	case sendCmd.Parsed():
+		if len(*sendFrom) == 0 || len(*sendTo) == 0 || *sendAmount < 0 || *sendFee < 0 {
 			sendCmd.Usage()
-			runtime.Goexit()
+			return ErrUsage
 		}
-		cli.send(*sendFrom, *sendTo, *sendAmount, nodeID, *sendMine)
-	}
-	if createWalletCmd.Parsed() {
-		cli.createWallet(nodeID)
-	}
-	if listAddressesCmd.Parsed() {
-		cli.listAddresses(nodeID)
-	}
-	if reindexUTXOCmd.Parsed() {
-		cli.reindexUTXO(nodeID)
-	}
-	if startNodeCmd.Parsed() {
-		nodeID := os.Getenv("NODE_ID")
-		if len(nodeID) == 0 {
-			startNodeCmd.Usage()
-			runtime.Goexit()
+		return cli.send(*sendFrom, *sendTo, *sendAmount, *sendFee, nodeID, *sendMine)
+	case createWalletCmd.Parsed():
+		return cli.createWallet(nodeID)
+	case listAddressesCmd.Parsed():
+		return cli.listAddresses(nodeID)
+	case reindexUTXOCmd.Parsed():
+		return cli.reindexUTXO(nodeID)
+	case reindexTxCmd.Parsed():
+		return cli.reindexTx(nodeID, *reindexTxDisable)
+	case getTransactionCmd.Parsed():
+		if len(*getTransactionID) == 0 {
+			getTransactionCmd.Usage()
+			return ErrUsage
+		}
+		return cli.getTransaction(*getTransactionID, nodeID)
+	case reindexAddrCmd.Parsed():
+		return cli.reindexAddr(nodeID, *reindexAddrDisable)
+	case getAddressHistoryCmd.Parsed():
+		if len(*getAddressHistoryAddress) == 0 {
+			getAddressHistoryCmd.Usage()
+			return ErrUsage
+		}
+		return cli.getAddressHistory(*getAddressHistoryAddress, nodeID)
+	case getSupplyCmd.Parsed():
+		return cli.getSupply(*getSupplyHeight, nodeID)
+	case startNodeCmd.Parsed():
+		return cli.StartNode(nodeID, *startNodeMiner)
+	case mineCmd.Parsed():
+		if len(*mineAddress) == 0 {
+			mineCmd.Usage()
+			return ErrUsage
+		}
+		if len(*mineRPC) == 0 {
+			*mineRPC, err = network.RPCAddress(nodeID)
+			if err != nil {
+				return err
+			}
+		}
+		return cli.mine(*mineAddress, *mineRPC, nodeID)
+	case getPeerInfoCmd.Parsed():
+		if len(*getPeerInfoRPC) == 0 {
+			*getPeerInfoRPC, err = network.RPCAddress(nodeID)
+			if err != nil {
+				return err
+			}
 		}
-		cli.StartNode(nodeID, *startNodeMiner)
+		return cli.getPeerInfo(*getPeerInfoRPC)
+	case addNodeCmd.Parsed():
+		if len(*addNodeAddress) == 0 {
+			addNodeCmd.Usage()
+			return ErrUsage
+		}
+		if len(*addNodeRPC) == 0 {
+			*addNodeRPC, err = network.RPCAddress(nodeID)
+			if err != nil {
+				return err
+			}
+		}
+		return cli.addNode(*addNodeAddress, *addNodeRPC)
+	case disconnectNodeCmd.Parsed():
+		if len(*disconnectNodeAddress) == 0 {
+			disconnectNodeCmd.Usage()
+			return ErrUsage
+		}
+		if len(*disconnectNodeRPC) == 0 {
+			*disconnectNodeRPC, err = network.RPCAddress(nodeID)
+			if err != nil {
+				return err
+			}
+		}
+		return cli.disconnectNode(*disconnectNodeAddress, *disconnectNodeRPC)
 	}
-}
 
-func Handle(err error) {
-	if err != nil {
-		log.Panic(err)
-	}
+	return nil
 }
@@ -0,0 +1,31 @@
+// Package consensus implements the engines that seal and verify blocks:
+// proof-of-work for public networks and proof-of-authority, where a set of
+// validators sign blocks in turn, for private ones.
+package consensus
+
+import (
+	"fmt"
+
+	"github.com/phnaharris/harris-blockchain-token/blockchain"
+	"github.com/phnaharris/harris-blockchain-token/chaincfg"
+	"github.com/phnaharris/harris-blockchain-token/wallet"
+)
+
+type Engine = blockchain.Engine
+
+// New returns the engine of a network. signer is the wallet signing the
+// blocks of this node with proof-of-authority, it may be nil.
+func New(params *chaincfg.Params, signer *wallet.Wallet) (Engine, error) {
+	switch params.Engine {
+	case chaincfg.PoW:
+		return NewProofOfWork(params), nil
+	case chaincfg.PoA:
+		poa, err := NewProofOfAuthority(params, signer)
+		if err != nil {
+			return nil, err
+		}
+		return poa, nil
+	default:
+		return nil, fmt.Errorf("unknown consensus engine %q", params.Engine)
+	}
+}
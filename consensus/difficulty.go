@@ -0,0 +1,114 @@
+package consensus
+
+import (
+	"math/big"
+
+	"github.com/phnaharris/harris-blockchain-token/blockchain"
+)
+
+// targetForDifficulty is the target of a hash with difficulty leading zero
+// bits.
+func targetForDifficulty(difficulty int) *big.Int {
+	return new(big.Int).Lsh(big.NewInt(1), uint(256-difficulty))
+}
+
+// CompactToBig expands the compact form of a target: the first byte is the
+// length of the number in bytes, the other three are its most significant
+// bytes, 0x00800000 being a sign bit.
+func CompactToBig(compact uint32) *big.Int {
+	mantissa := compact & 0x007fffff
+	isNegative := compact&0x00800000 != 0
+	exponent := uint(compact >> 24)
+
+	var target *big.Int
+	if exponent <= 3 {
+		mantissa >>= 8 * (3 - exponent)
+		target = big.NewInt(int64(mantissa))
+	} else {
+		target = big.NewInt(int64(mantissa))
+		target.Lsh(target, 8*(exponent-3))
+	}
+
+	if isNegative {
+		target = target.Neg(target)
+	}
+
+	return target
+}
+
+// BigToCompact is the inverse of CompactToBig, precision below the three
+// most significant bytes is lost.
+func BigToCompact(target *big.Int) uint32 {
+	if target.Sign() == 0 {
+		return 0
+	}
+
+	var mantissa uint32
+	exponent := uint(len(target.Bytes()))
+	if exponent <= 3 {
+		mantissa = uint32(target.Bits()[0])
+		mantissa <<= 8 * (3 - exponent)
+	} else {
+		tmp := new(big.Int).Set(target)
+		tmp.Abs(tmp)
+		mantissa = uint32(tmp.Rsh(tmp, 8*(exponent-3)).Bits()[0])
+	}
+
+	// keep the sign bit free
+	if mantissa&0x00800000 != 0 {
+		mantissa >>= 8
+		exponent++
+	}
+
+	compact := uint32(exponent<<24) | mantissa
+	if target.Sign() < 0 {
+		compact |= 0x00800000
+	}
+
+	return compact
+}
+
+// CalcDifficulty returns the difficulty a block on top of parent must use. It
+// changes every RetargetInterval blocks by the ratio between the time the
+// last interval took and the expected time, bounded by MaxRetargetFactor.
+func (pow *ProofOfWork) CalcDifficulty(chain *blockchain.Blockchain, parent *blockchain.BlockHeader) (uint32, error) {
+	if parent == nil {
+		return pow.initialBits, nil
+	}
+
+	p := pow.params
+	height := parent.Height + 1
+	if p.NoRetargeting || height%p.RetargetInterval != 0 {
+		return parent.Bits, nil
+	}
+
+	// find the first block of the interval on the parent branch, the
+	// interval spans RetargetInterval-1 block times
+	first := parent
+	for i := 0; i < p.RetargetInterval-1 && len(first.PrevHash) > 0; i++ {
+		prev, err := chain.GetBlock(first.PrevHash)
+		if err != nil {
+			return 0, err
+		}
+		first = &prev.BlockHeader
+	}
+
+	expected := int64((p.RetargetInterval - 1) * p.TargetBlockSpacing)
+	factor := int64(p.MaxRetargetFactor)
+	actual := parent.Timestamp - first.Timestamp
+	if actual < expected/factor {
+		actual = expected / factor
+	}
+	if actual > expected*factor {
+		actual = expected * factor
+	}
+
+	target := CompactToBig(parent.Bits)
+	target.Mul(target, big.NewInt(actual))
+	target.Div(target, big.NewInt(expected))
+	if target.Cmp(pow.powLimit) > 0 {
+		target.Set(pow.powLimit)
+	}
+
+	return BigToCompact(target), nil
+}
@@ -0,0 +1,156 @@
+package consensus
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/big"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/phnaharris/harris-blockchain-token/blockchain"
+)
+
+// hashes a worker does between two checks of its context
+const cancelCheckInterval = 1 << 12
+
+var ErrNonceExhausted = errors.New("nonce space exhausted and block has no coinbase")
+
+// Miner searches proof-of-work on all cores. Each worker gets a slice of the
+// nonce space, when it is exhausted the extra-nonce in the coinbase is
+// increased, which changes the merkle root, and the search starts again.
+type Miner struct {
+	Workers int
+
+	hashes  uint64 // hashes done by the last Mine, updated atomically
+	elapsed time.Duration
+}
+
+func NewMiner() *Miner {
+	return &Miner{Workers: runtime.NumCPU()}
+}
+
+// Mine sets the nonce and hash of block. It returns the context error when
+// ctx is done first, for instance because the tip the block builds on was
+// replaced.
+func (m *Miner) Mine(ctx context.Context, block *blockchain.Block) error {
+	start := time.Now()
+	atomic.StoreUint64(&m.hashes, 0)
+	defer func() { m.elapsed = time.Since(start) }()
+
+	target := CompactToBig(block.Bits)
+
+	var coinbaseData []byte
+	if len(block.Transaction) > 0 && block.Transaction[0].IsCoinbase() {
+		coinbaseData = append([]byte{}, block.Transaction[0].Inputs[0].PubKey...)
+	}
+
+	for extraNonce := uint64(1); ; extraNonce++ {
+		nonce, found := m.search(ctx, block.BlockHeader, target)
+		if err := ctx.Err(); err != nil && !found {
+			return err
+		}
+		if found {
+			block.Nonce = nonce
+			block.Hash = block.BlockHeader.Hash()
+			return nil
+		}
+
+		if coinbaseData == nil {
+			return ErrNonceExhausted
+		}
+
+		// the coinbase input keeps arbitrary data, append the extra-nonce
+		coinbase := block.Transaction[0]
+		extra := make([]byte, 8)
+		binary.BigEndian.PutUint64(extra, extraNonce)
+		coinbase.Inputs[0].PubKey = append(append([]byte{}, coinbaseData...), extra...)
+		coinbase.ID = coinbase.Hash()
+
+		block.MerkleRoot = block.HashTransaction()
+		// the timestamp may be ahead of the clock to follow the
+		// previous blocks, never move it back
+		if now := time.Now().Unix(); now > block.Timestamp {
+			block.Timestamp = now
+		}
+	}
+}
+
+// search runs the workers over the whole nonce space of header.
+func (m *Miner) search(ctx context.Context, header blockchain.BlockHeader, target *big.Int) (uint32, bool) {
+	workers := m.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan uint32, workers)
+	var wg sync.WaitGroup
+
+	space := uint64(math.MaxUint32) + 1
+	chunk := space / uint64(workers)
+
+	for i := 0; i < workers; i++ {
+		from := uint64(i) * chunk
+		to := from + chunk
+		if i == workers-1 {
+			to = space
+		}
+
+		wg.Add(1)
+		go func(header blockchain.BlockHeader, from, to uint64) {
+			defer wg.Done()
+
+			var intHash big.Int
+			done := uint64(0)
+
+			for nonce := from; nonce < to; nonce++ {
+				if done == cancelCheckInterval {
+					atomic.AddUint64(&m.hashes, done)
+					done = 0
+					if ctx.Err() != nil {
+						return
+					}
+				}
+
+				header.Nonce = uint32(nonce)
+				hash := sha256.Sum256(header.Serialize())
+				done++
+
+				intHash.SetBytes(hash[:])
+				if intHash.Cmp(target) == -1 {
+					atomic.AddUint64(&m.hashes, done)
+					results <- uint32(nonce)
+					cancel()
+					return
+				}
+			}
+			atomic.AddUint64(&m.hashes, done)
+		}(header, from, to)
+	}
+
+	wg.Wait()
+
+	select {
+	case nonce := <-results:
+		return nonce, true
+	default:
+		return 0, false
+	}
+}
+
+// HashRate is the number of hashes per second of the last Mine.
+func (m *Miner) HashRate() float64 {
+	seconds := m.elapsed.Seconds()
+	if seconds == 0 {
+		return 0
+	}
+
+	return float64(atomic.LoadUint64(&m.hashes)) / seconds
+}
@@ -0,0 +1,155 @@
+package consensus
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/phnaharris/harris-blockchain-token/blockchain"
+	"github.com/phnaharris/harris-blockchain-token/chaincfg"
+	"github.com/phnaharris/harris-blockchain-token/wallet"
+)
+
+var (
+	ErrNoValidators = errors.New("proof-of-authority needs at least one validator")
+	ErrNoSigner     = errors.New("node has no validator key to sign blocks")
+	ErrNotInTurn    = errors.New("block is not signed by the validator in turn")
+	ErrBadSeal      = errors.New("block seal is not a valid signature")
+)
+
+// ProofOfAuthority accepts a block signed by the validator in turn: the
+// validators sign blocks in rotation, the block at height h by validator
+// h modulo their number. Every block weighs the same, so the longest chain
+// wins. The genesis block is fixed by the network parameters and has no
+// signature.
+type ProofOfAuthority struct {
+	Validators [][]byte // public key hashes of the validators, in turn order
+
+	genesis []byte // hash of the genesis block
+	signer  *wallet.Wallet
+}
+
+// NewProofOfAuthority returns the engine of the validators of a network.
+// signer signs the blocks of this node, it is nil when the node only checks
+// blocks.
+func NewProofOfAuthority(params *chaincfg.Params, signer *wallet.Wallet) (*ProofOfAuthority, error) {
+	if len(params.Validators) == 0 {
+		return nil, ErrNoValidators
+	}
+
+	genesis, err := hex.DecodeString(params.Genesis.Hash)
+	if err != nil {
+		return nil, err
+	}
+
+	poa := &ProofOfAuthority{genesis: genesis, signer: signer}
+	for _, address := range params.Validators {
+		if !wallet.ValidateAddress([]byte(address), params) {
+			return nil, fmt.Errorf("validator address %q is not valid", address)
+		}
+		pubKeyHash, err := wallet.Base58Decode([]byte(address))
+		if err != nil {
+			return nil, err
+		}
+		pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-wallet.ChecksumLength]
+		poa.Validators = append(poa.Validators, pubKeyHash)
+	}
+
+	return poa, nil
+}
+
+// InTurn returns the public key hash of the validator signing at height.
+func (poa *ProofOfAuthority) InTurn(height int) []byte {
+	return poa.Validators[height%len(poa.Validators)]
+}
+
+// Seal signs the block hash with the key of the node, which must be the one
+// of the validator in turn. The seal is the public key followed by the
+// signature:
+//
+//	len(pubkey)(1) | pubkey | len(r)(1) | r | s
+func (poa *ProofOfAuthority) Seal(ctx context.Context, block *blockchain.Block) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if poa.signer == nil {
+		return ErrNoSigner
+	}
+	if !bytes.Equal(wallet.PublicKeyHash(poa.signer.PublicKey), poa.InTurn(block.Height)) {
+		return ErrNotInTurn
+	}
+
+	block.Hash = block.BlockHeader.Hash()
+	r, s, err := ecdsa.Sign(rand.Reader, &poa.signer.PrivateKey, block.Hash)
+	if err != nil {
+		return err
+	}
+
+	pubKey := poa.signer.PublicKey
+	seal := append([]byte{byte(len(pubKey))}, pubKey...)
+	seal = append(seal, byte(len(r.Bytes())))
+	seal = append(seal, r.Bytes()...)
+	block.Seal = append(seal, s.Bytes()...)
+
+	fmt.Printf("Block signed! Block hash: %x.\n", block.Hash)
+
+	return nil
+}
+
+func (poa *ProofOfAuthority) VerifyHeader(header *blockchain.BlockHeader, seal []byte) error {
+	if header.Bits != 0 {
+		return ErrInvalidBits
+	}
+	if header.Height == 0 && len(seal) == 0 && bytes.Equal(header.Hash(), poa.genesis) {
+		return nil
+	}
+
+	pubKey, r, s, ok := parseSeal(seal)
+	if !ok {
+		return ErrBadSeal
+	}
+	if !bytes.Equal(wallet.PublicKeyHash(pubKey), poa.InTurn(header.Height)) {
+		return ErrNotInTurn
+	}
+
+	x := new(big.Int).SetBytes(pubKey[:len(pubKey)/2])
+	y := new(big.Int).SetBytes(pubKey[len(pubKey)/2:])
+	key := ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+	if !ecdsa.Verify(&key, header.Hash(), r, s) {
+		return ErrBadSeal
+	}
+
+	return nil
+}
+
+func parseSeal(seal []byte) (pubKey []byte, r, s *big.Int, ok bool) {
+	if len(seal) < 1 || len(seal) < 1+int(seal[0])+1 {
+		return nil, nil, nil, false
+	}
+	pubKey = seal[1 : 1+int(seal[0])]
+	sig := seal[1+int(seal[0]):]
+
+	rLen := int(sig[0])
+	if len(pubKey) == 0 || len(sig) < 1+rLen+1 {
+		return nil, nil, nil, false
+	}
+	r = new(big.Int).SetBytes(sig[1 : 1+rLen])
+	s = new(big.Int).SetBytes(sig[1+rLen:])
+
+	return pubKey, r, s, true
+}
+
+// CalcDifficulty is always zero, authority blocks have no target.
+func (poa *ProofOfAuthority) CalcDifficulty(chain *blockchain.Blockchain, parent *blockchain.BlockHeader) (uint32, error) {
+	return 0, nil
+}
+
+func (poa *ProofOfAuthority) Work(header *blockchain.BlockHeader) *big.Int {
+	return big.NewInt(1)
+}
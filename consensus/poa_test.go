@@ -0,0 +1,104 @@
+package consensus_test
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/phnaharris/harris-blockchain-token/blockchain"
+	"github.com/phnaharris/harris-blockchain-token/chaincfg"
+	"github.com/phnaharris/harris-blockchain-token/consensus"
+	"github.com/phnaharris/harris-blockchain-token/storage"
+	"github.com/phnaharris/harris-blockchain-token/wallet"
+)
+
+// poaNet returns the parameters of the authority network with the validators
+// in its validators file.
+func poaNet(t *testing.T, validators ...*wallet.Wallet) *chaincfg.Params {
+	t.Helper()
+
+	params := chaincfg.PoANetParams
+	params.DataDir = t.TempDir()
+
+	content := "# validators in turn order\n"
+	for _, w := range validators {
+		content += fmt.Sprintf("%s\n", w.Address(&params))
+	}
+	if err := ioutil.WriteFile(filepath.Join(params.DataDir, "validators"), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := params.LoadValidators(); err != nil {
+		t.Fatal(err)
+	}
+	if len(params.Validators) != len(validators) {
+		t.Fatalf("loaded %d validators, want %d", len(params.Validators), len(validators))
+	}
+
+	return &params
+}
+
+func TestPoANetwork(t *testing.T) {
+	first, err := wallet.MakeWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := wallet.MakeWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := poaNet(t, first, second)
+
+	net, err := chaincfg.ByName("poanet")
+	if err != nil || net.Engine != chaincfg.PoA {
+		t.Fatalf("poanet is not a proof-of-authority network: %v", err)
+	}
+
+	engine, err := consensus.New(params, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	genesis := blockchain.GenesisBlock(params)
+	if hash := hex.EncodeToString(genesis.Hash); hash != params.Genesis.Hash {
+		t.Fatalf("genesis hash %s, want %s", hash, params.Genesis.Hash)
+	}
+	if err := engine.VerifyHeader(&genesis.BlockHeader, genesis.Seal); err != nil {
+		t.Errorf("genesis: %v", err)
+	}
+
+	// only the genesis block goes without a signature
+	forged := genesis.BlockHeader
+	forged.Nonce++
+	if err := engine.VerifyHeader(&forged, nil); !errors.Is(err, consensus.ErrBadSeal) {
+		t.Errorf("unsigned block at height 0: got %v, want ErrBadSeal", err)
+	}
+
+	chain, err := blockchain.NewBlockchain(storage.NewMemory(), params, engine)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the second validator signs height 1
+	coinbase, err := blockchain.CoinbaseTx(string(first.Address(params)), "", params.Subsidy.BlockSubsidy(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := chain.MineBlock([]*blockchain.Transaction{coinbase}); !errors.Is(err, consensus.ErrNotInTurn) {
+		t.Fatalf("block of the first validator at height 1: got %v, want ErrNotInTurn", err)
+	}
+
+	chain.Engine, err = consensus.New(params, second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := chain.MineBlock([]*blockchain.Transaction{coinbase})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := engine.VerifyHeader(&block.BlockHeader, block.Seal); err != nil {
+		t.Errorf("block of the second validator: %v", err)
+	}
+}
@@ -0,0 +1,79 @@
+package consensus
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/phnaharris/harris-blockchain-token/blockchain"
+	"github.com/phnaharris/harris-blockchain-token/chaincfg"
+)
+
+var (
+	ErrInvalidProofOfWork = errors.New("block does not satisfy proof-of-work")
+	ErrInvalidBits        = errors.New("block target is out of range")
+	ErrUnexpectedSeal     = errors.New("proof-of-work block has a seal")
+)
+
+// ProofOfWork accepts a block whose hash is below the target of its bits,
+// the target follows the time the last blocks took.
+type ProofOfWork struct {
+	params      *chaincfg.Params
+	powLimit    *big.Int // easiest allowed target
+	initialBits uint32   // bits of the genesis block
+}
+
+func NewProofOfWork(params *chaincfg.Params) *ProofOfWork {
+	return &ProofOfWork{
+		params:      params,
+		powLimit:    targetForDifficulty(params.MinDifficulty),
+		initialBits: BigToCompact(targetForDifficulty(params.InitialDifficulty)),
+	}
+}
+
+// Seal mines block on every core until it is done or ctx is.
+func (pow *ProofOfWork) Seal(ctx context.Context, block *blockchain.Block) error {
+	miner := NewMiner()
+	if err := miner.Mine(ctx, block); err != nil {
+		return err
+	}
+
+	fmt.Printf("Nonce: %d.\n", block.Nonce)
+	fmt.Printf("POW: %x.\n", block.Hash)
+	fmt.Printf("Hashrate: %.0f H/s on %d workers.\n", miner.HashRate(), miner.Workers)
+	fmt.Printf("Block created! Block hash: %x.\n", block.Hash)
+
+	return nil
+}
+
+func (pow *ProofOfWork) VerifyHeader(header *blockchain.BlockHeader, seal []byte) error {
+	if len(seal) > 0 {
+		return ErrUnexpectedSeal
+	}
+
+	// the smaller the target, the more difficult the block
+	target := CompactToBig(header.Bits)
+	if target.Sign() <= 0 || target.Cmp(pow.powLimit) > 0 {
+		return ErrInvalidBits
+	}
+
+	var intHash big.Int
+	hash := sha256.Sum256(header.Serialize())
+	intHash.SetBytes(hash[:])
+	if intHash.Cmp(target) != -1 {
+		return ErrInvalidProofOfWork
+	}
+
+	return nil
+}
+
+// Work is the expected number of hashes needed to find a block at the
+// target: 2^256 / (target + 1).
+func (pow *ProofOfWork) Work(header *blockchain.BlockHeader) *big.Int {
+	denominator := new(big.Int).Add(CompactToBig(header.Bits), big.NewInt(1))
+	numerator := new(big.Int).Lsh(big.NewInt(1), 256)
+
+	return numerator.Div(numerator, denominator)
+}
@@ -1,14 +1,20 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"os"
 
 	"github.com/phnaharris/harris-blockchain-token/cli"
 )
 
 func main() {
-	defer os.Exit(0)
-
 	cmd := cli.CommandLine{}
-	cmd.Run()
+	if err := cmd.Run(); err != nil {
+		// the usage of the command is printed already
+		if !errors.Is(err, cli.ErrUsage) {
+			fmt.Fprintf(os.Stderr, "Error: %s.\n", err)
+		}
+		os.Exit(1)
+	}
 }
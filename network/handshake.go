@@ -0,0 +1,216 @@
+package network
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// A connection starts with a handshake: each side sends a version message
+// and answers the one of the other side with a verack. The node that dialed
+// sends its version first. Other messages are accepted only once the version
+// and the verack of the peer are received.
+const (
+	// ProtocolVersion is the version of the messages of this node, peers
+	// older than MinProtocolVersion are disconnected.
+	ProtocolVersion    = 2
+	MinProtocolVersion = 2
+
+	userAgent = "/harris-blockchain-token:0.2/"
+
+	handshakeTimeout = 30 * time.Second
+)
+
+// Services of a node, as bits of Version.Services.
+const (
+	// SFNodeNetwork is set by nodes keeping the chain, which serve blocks.
+	SFNodeNetwork uint64 = 1 << iota
+)
+
+var (
+	ErrHandshake         = errors.New("handshake failed")
+	ErrHandshakeTimeout  = errors.New("handshake timed out")
+	ErrObsoleteVersion   = errors.New("protocol version is too old")
+	ErrSelfConnection    = errors.New("connected to self")
+	ErrHandshakeRequired = errors.New("message before the handshake")
+)
+
+// nodeNonce is sent in the version messages of this process, receiving it
+// back means the connection loops to this node.
+var nodeNonce = newNonce()
+
+func newNonce() uint64 {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		// a time based nonce still tells apart the processes of a host
+		return uint64(time.Now().UnixNano())
+	}
+
+	return binary.BigEndian.Uint64(b[:])
+}
+
+// localVersion is the version message of this node.
+func localVersion() (Version, error) {
+	ver := Version{
+		Version:   ProtocolVersion,
+		Nonce:     nodeNonce,
+		UserAgent: userAgent,
+		AddrFrom:  nodeAddress,
+	}
+
+	if chain := nodeChain; chain != nil {
+		height, err := chain.GetBestHeight()
+		if err != nil {
+			return Version{}, err
+		}
+		ver.Services |= SFNodeNetwork
+		ver.StartHeight = height
+	}
+
+	return ver, nil
+}
+
+func (p *Peer) sendVersion() error {
+	ver, err := localVersion()
+	if err != nil {
+		return err
+	}
+
+	return p.queue("version", ver)
+}
+
+// handleHandshake handles the version and verack messages of the peer.
+func (p *Peer) handleHandshake(msg Message) error {
+	switch msg.Command {
+	case "version":
+		return p.handleVersion(msg.Payload)
+	case "verack":
+		return p.handleVerack()
+	}
+
+	return nil
+}
+
+func (p *Peer) handleVersion(data []byte) error {
+	if p.versionReceived {
+		return fmt.Errorf("%w: duplicate version", ErrHandshake)
+	}
+
+	var payload Version
+	if err := decodePayload(data, &payload); err != nil {
+		return err
+	}
+
+	if payload.Nonce == nodeNonce {
+		if !p.inbound {
+			// do not dial it again
+			manager.Remove(p.addr)
+		}
+		return ErrSelfConnection
+	}
+	if payload.Version < MinProtocolVersion {
+		return fmt.Errorf("%w: %d, %d at least", ErrObsoleteVersion, payload.Version, MinProtocolVersion)
+	}
+
+	p.mu.Lock()
+	p.version = payload
+	p.protocolVersion = payload.Version
+	if p.protocolVersion > ProtocolVersion {
+		p.protocolVersion = ProtocolVersion
+	}
+	p.mu.Unlock()
+	p.versionReceived = true
+
+	if p.inbound {
+		setPeerAddr(p, payload.AddrFrom)
+		if err := p.sendVersion(); err != nil {
+			return err
+		}
+	}
+	if err := p.queue("verack", Verack{}); err != nil {
+		return err
+	}
+
+	return p.checkHandshake()
+}
+
+func (p *Peer) handleVerack() error {
+	if p.verackReceived {
+		return fmt.Errorf("%w: duplicate verack", ErrHandshake)
+	}
+	// an inbound peer can only acknowledge the version it was answered
+	if p.inbound && !p.versionReceived {
+		return fmt.Errorf("%w: verack before version", ErrHandshake)
+	}
+	p.verackReceived = true
+
+	return p.checkHandshake()
+}
+
+// checkHandshake completes the handshake once the version and the verack of
+// the peer are received. The node then records the peer in the address book,
+// shares the addresses it knows and asks for the blocks it misses.
+func (p *Peer) checkHandshake() error {
+	if !p.versionReceived || !p.verackReceived {
+		return nil
+	}
+	close(p.ready)
+
+	ver, _ := p.Version()
+	fmt.Printf("Connected to %s: %s, protocol %d, height %d.\n", p.Addr(), ver.UserAgent, p.ProtocolVersion(), ver.StartHeight)
+
+	chain := nodeChain
+	if chain == nil {
+		return nil
+	}
+
+	// nodes that dialed this one are known by the address they listen at
+	if !p.inbound {
+		manager.Good(p.Addr())
+	} else if ver.Services&SFNodeNetwork != 0 {
+		manager.Good(ver.AddrFrom)
+	}
+	if err := p.Send("addr", Addr{addressList()}); err != nil {
+		return err
+	}
+
+	height, err := chain.GetBestHeight()
+	if err != nil {
+		return err
+	}
+	if ver.StartHeight > height && ver.Services&SFNodeNetwork != 0 {
+		return p.Send("getblocks", GetBlocks{nodeAddress})
+	}
+
+	return nil
+}
+
+// Version returns the version message of the peer, false until it is
+// received.
+func (p *Peer) Version() (Version, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.version, p.protocolVersion > 0
+}
+
+// ProtocolVersion is the version both sides of the connection speak, zero
+// before the handshake.
+func (p *Peer) ProtocolVersion() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.protocolVersion
+}
+
+// handshakeDone tells if messages other than the handshake are accepted.
+func (p *Peer) handshakeDone() bool {
+	select {
+	case <-p.ready:
+		return true
+	default:
+		return false
+	}
+}
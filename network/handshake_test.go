@@ -0,0 +1,168 @@
+package network
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// testPeer runs a peer on one end of a pipe. It returns the other end and
+// the messages the peer writes there, the channel is closed with the
+// connection.
+func testPeer(t *testing.T, addr string, inbound bool) (*Peer, net.Conn, <-chan Message) {
+	t.Helper()
+
+	local, remote := net.Pipe()
+	p := newPeer(local, addr, inbound)
+	p.start()
+
+	received := make(chan Message, sendQueueSize)
+	go func() {
+		defer close(received)
+		for {
+			msg, err := ReadMessage(remote, netParams.Magic)
+			if err != nil {
+				return
+			}
+			received <- msg
+		}
+	}()
+
+	t.Cleanup(func() {
+		p.Disconnect()
+		<-p.done
+		remote.Close()
+	})
+
+	return p, remote, received
+}
+
+// sendPeer writes a message to the peer, the write fails once the peer has
+// closed the connection.
+func sendPeer(t *testing.T, conn net.Conn, command string, payload interface{}) error {
+	t.Helper()
+
+	data, err := GobEncode(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return WriteMessage(conn, netParams.Magic, Message{command, data})
+}
+
+func waitDisconnected(t *testing.T, p *Peer) {
+	t.Helper()
+
+	select {
+	case <-p.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("peer is still connected")
+	}
+}
+
+func checkConnected(t *testing.T, p *Peer) {
+	t.Helper()
+
+	select {
+	case <-p.done:
+		t.Fatal("peer was disconnected")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// commands lists the commands of received once the connection is closed.
+func commands(received <-chan Message) []string {
+	var commands []string
+	for msg := range received {
+		commands = append(commands, msg.Command)
+	}
+
+	return commands
+}
+
+// peerVersion is the version message of another node.
+func peerVersion() Version {
+	return Version{Version: ProtocolVersion, Nonce: nodeNonce + 1, UserAgent: "/test/", AddrFrom: "127.0.0.1:1"}
+}
+
+func TestHandshakeSelfConnection(t *testing.T) {
+	ver := peerVersion()
+	ver.Nonce = nodeNonce
+
+	p, conn, received := testPeer(t, "127.0.0.1:2", true)
+	sendPeer(t, conn, "version", ver)
+	waitDisconnected(t, p)
+	if sent := commands(received); len(sent) != 0 {
+		t.Errorf("inbound connection to self was answered with %v", sent)
+	}
+
+	// the address of an outbound connection to self is forgotten
+	addr := "127.0.0.1:3"
+	manager.AddNode(addr)
+	p, conn, received = testPeer(t, addr, false)
+	sendPeer(t, conn, "version", ver)
+	waitDisconnected(t, p)
+	if sent := commands(received); len(sent) != 0 {
+		t.Errorf("outbound connection to self was answered with %v", sent)
+	}
+	if manager.Known(addr) {
+		t.Errorf("address %s of this node is still in the address book", addr)
+	}
+}
+
+func TestHandshakeObsoleteVersion(t *testing.T) {
+	ver := peerVersion()
+	ver.Version = MinProtocolVersion - 1
+
+	p, conn, received := testPeer(t, "127.0.0.1:4", true)
+	sendPeer(t, conn, "version", ver)
+	waitDisconnected(t, p)
+	if sent := commands(received); len(sent) != 0 {
+		t.Errorf("peer of protocol %d was answered with %v", ver.Version, sent)
+	}
+}
+
+func TestHandshakeRequired(t *testing.T) {
+	// a message before the version
+	p, conn, _ := testPeer(t, "127.0.0.1:5", true)
+	sendPeer(t, conn, "addr", Addr{})
+	waitDisconnected(t, p)
+
+	// a message after the version but before the verack
+	p, conn, received := testPeer(t, "127.0.0.1:6", true)
+	if err := sendPeer(t, conn, "version", peerVersion()); err != nil {
+		t.Fatal(err)
+	}
+	sendPeer(t, conn, "addr", Addr{})
+	waitDisconnected(t, p)
+	if sent := commands(received); len(sent) != 2 || sent[0] != "version" || sent[1] != "verack" {
+		t.Errorf("version was answered with %v, want [version verack]", sent)
+	}
+	if p.handshakeDone() {
+		t.Error("handshake is done without the verack of the peer")
+	}
+
+	// once the handshake is done other messages are accepted
+	p, conn, _ = testPeer(t, "127.0.0.1:7", true)
+	for _, command := range []string{"version", "verack"} {
+		var payload interface{} = Verack{}
+		if command == "version" {
+			payload = peerVersion()
+		}
+		if err := sendPeer(t, conn, command, payload); err != nil {
+			t.Fatalf("%s: %v", command, err)
+		}
+	}
+	select {
+	case <-p.ready:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handshake is not done after version and verack")
+	}
+	if version := p.ProtocolVersion(); version != ProtocolVersion {
+		t.Errorf("protocol version %d, want %d", version, ProtocolVersion)
+	}
+	if err := sendPeer(t, conn, "addr", Addr{}); err != nil {
+		t.Fatal(err)
+	}
+	checkConnected(t, p)
+}
@@ -0,0 +1,99 @@
+package network
+
+import (
+	"encoding/hex"
+	"sync"
+
+	"github.com/phnaharris/harris-blockchain-token/blockchain"
+)
+
+// memPool keeps the transactions waiting to be mined by ID. Peers, the miner
+// and the RPC server use it from their own goroutines.
+type memPool struct {
+	mu  sync.Mutex
+	txs map[string]blockchain.Transaction
+}
+
+func newMemPool() *memPool {
+	return &memPool{txs: make(map[string]blockchain.Transaction)}
+}
+
+// Add puts tx in the pool, it returns false if it is there already.
+func (m *memPool) Add(tx blockchain.Transaction) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	txID := hex.EncodeToString(tx.ID)
+	if _, ok := m.txs[txID]; ok {
+		return false
+	}
+	m.txs[txID] = tx
+
+	return true
+}
+
+func (m *memPool) Get(txID []byte) (blockchain.Transaction, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tx, ok := m.txs[hex.EncodeToString(txID)]
+	return tx, ok
+}
+
+// RemoveBlock drops the transactions mined in block.
+func (m *memPool) RemoveBlock(block *blockchain.Block) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, tx := range block.Transaction {
+		delete(m.txs, hex.EncodeToString(tx.ID))
+	}
+}
+
+// RemoveConflicts drops the transactions spending an output that unspent
+// does not know of and no transaction left in the pool creates, the
+// transactions spending the outputs of a dropped one go as well.
+func (m *memPool) RemoveConflicts(unspent func(txID []byte, out int) bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for removed := true; removed; {
+		removed = false
+
+		for id, tx := range m.txs {
+			for _, in := range tx.Inputs {
+				if parent, ok := m.txs[hex.EncodeToString(in.ID)]; ok && in.Out >= 0 && in.Out < len(parent.Outputs) {
+					continue
+				}
+				if unspent(in.ID, in.Out) {
+					continue
+				}
+
+				delete(m.txs, id)
+				removed = true
+				break
+			}
+		}
+	}
+}
+
+func (m *memPool) Count() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.txs)
+}
+
+// Txs lists copies of the transactions of the pool.
+func (m *memPool) Txs() []*blockchain.Transaction {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	txs := make([]*blockchain.Transaction, 0, len(m.txs))
+	for id := range m.txs {
+		tx := m.txs[id]
+		txs = append(txs, &tx)
+	}
+
+	return txs
+}
@@ -0,0 +1,46 @@
+package network
+
+import (
+	"testing"
+
+	"github.com/phnaharris/harris-blockchain-token/blockchain"
+)
+
+// poolTx returns a transaction of ID id spending ins, with one output.
+func poolTx(id byte, ins ...blockchain.TxInput) blockchain.Transaction {
+	return blockchain.Transaction{
+		ID:      []byte{id},
+		Inputs:  ins,
+		Outputs: []blockchain.TxOutput{{Value: 1}},
+	}
+}
+
+func TestMemPoolRemoveConflicts(t *testing.T) {
+	pool := newMemPool()
+
+	// a spends an unspent output, b spends one spent by a mined block and c
+	// spends the output of b
+	a := poolTx(0xa, blockchain.TxInput{ID: []byte{1}, Out: 0})
+	b := poolTx(0xb, blockchain.TxInput{ID: []byte{2}, Out: 0})
+	c := poolTx(0xc, blockchain.TxInput{ID: b.ID, Out: 0})
+	for _, tx := range []blockchain.Transaction{a, b, c} {
+		pool.Add(tx)
+	}
+
+	pool.RemoveConflicts(func(txID []byte, out int) bool {
+		return txID[0] == 1
+	})
+
+	if _, ok := pool.Get(a.ID); !ok {
+		t.Errorf("transaction spending an unspent output was dropped")
+	}
+	if _, ok := pool.Get(b.ID); ok {
+		t.Errorf("transaction spending a spent output is still in the pool")
+	}
+	if _, ok := pool.Get(c.ID); ok {
+		t.Errorf("transaction spending the output of a dropped one is still in the pool")
+	}
+	if count := pool.Count(); count != 1 {
+		t.Errorf("pool has %d transactions, want 1", count)
+	}
+}
@@ -0,0 +1,92 @@
+package network
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Every message is sent in an envelope:
+//
+//	magic(4) | command(12) | length(4) | checksum(4) | payload
+//
+// The magic is the one of the network, the command is padded with zeros, the
+// length is the one of the payload and the checksum is the first 4 bytes of
+// its double SHA-256. The numbers are big endian.
+const (
+	headerLength   = 4 + commandLength + 4 + 4
+	checksumLength = 4
+
+	// MaxMessageSize bounds the payload of a message, it leaves room for
+	// the inventory of a long chain, blocks are much smaller.
+	MaxMessageSize = 32 << 20
+)
+
+var (
+	ErrWrongMagic      = errors.New("message of another network")
+	ErrMessageTooLarge = errors.New("message is too large")
+	ErrBadChecksum     = errors.New("message checksum does not match")
+)
+
+// Message is a command with its gob encoded payload.
+type Message struct {
+	Command string
+	Payload []byte
+}
+
+func messageChecksum(payload []byte) []byte {
+	first := sha256.Sum256(payload)
+	second := sha256.Sum256(first[:])
+
+	return second[:checksumLength]
+}
+
+// WriteMessage writes msg in its envelope to w.
+func WriteMessage(w io.Writer, magic uint32, msg Message) error {
+	if len(msg.Command) > commandLength {
+		return fmt.Errorf("command %q is longer than %d bytes", msg.Command, commandLength)
+	}
+	if len(msg.Payload) > MaxMessageSize {
+		return fmt.Errorf("%w: %d bytes", ErrMessageTooLarge, len(msg.Payload))
+	}
+
+	header := make([]byte, headerLength)
+	binary.BigEndian.PutUint32(header, magic)
+	copy(header[4:], CmdToBytes(msg.Command))
+	binary.BigEndian.PutUint32(header[4+commandLength:], uint32(len(msg.Payload)))
+	copy(header[4+commandLength+4:], messageChecksum(msg.Payload))
+
+	_, err := w.Write(append(header, msg.Payload...))
+	return err
+}
+
+// ReadMessage reads the next message of the network of magic from r. After
+// an error the stream cannot be trusted anymore and should be closed.
+func ReadMessage(r io.Reader, magic uint32) (Message, error) {
+	header := make([]byte, headerLength)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return Message{}, err
+	}
+
+	if got := binary.BigEndian.Uint32(header); got != magic {
+		return Message{}, fmt.Errorf("%w: magic %08x", ErrWrongMagic, got)
+	}
+	command := BytesToCmd(header[4 : 4+commandLength])
+	length := binary.BigEndian.Uint32(header[4+commandLength:])
+	if length > MaxMessageSize {
+		return Message{}, fmt.Errorf("%w: %s of %d bytes", ErrMessageTooLarge, command, length)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return Message{}, err
+	}
+	if !bytes.Equal(header[4+commandLength+4:], messageChecksum(payload)) {
+		return Message{}, fmt.Errorf("%w: %s", ErrBadChecksum, command)
+	}
+
+	return Message{command, payload}, nil
+}
@@ -0,0 +1,89 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+const testMagic = 0x01020304
+
+func TestMessageRoundTrip(t *testing.T) {
+	messages := []Message{
+		{"version", []byte("payload of a version")},
+		{"verack", []byte{}},
+		{"getblocks", bytes.Repeat([]byte{0xab}, 1000)},
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	written := make(chan error, 1)
+	go func() {
+		for _, msg := range messages {
+			if err := WriteMessage(client, testMagic, msg); err != nil {
+				written <- err
+				return
+			}
+		}
+		written <- nil
+	}()
+
+	for _, want := range messages {
+		got, err := ReadMessage(server, testMagic)
+		if err != nil {
+			t.Fatalf("%s: %v", want.Command, err)
+		}
+		if got.Command != want.Command || !bytes.Equal(got.Payload, want.Payload) {
+			t.Errorf("read %s of %d bytes, want %s of %d bytes", got.Command, len(got.Payload), want.Command, len(want.Payload))
+		}
+	}
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMessageRejects(t *testing.T) {
+	encode := func(magic uint32, msg Message) []byte {
+		var buffer bytes.Buffer
+		if err := WriteMessage(&buffer, magic, msg); err != nil {
+			t.Fatal(err)
+		}
+		return buffer.Bytes()
+	}
+	msg := Message{"tx", []byte("payload of a transaction")}
+
+	badChecksum := encode(testMagic, msg)
+	badChecksum[len(badChecksum)-1] ^= 0xff
+
+	// only the header is sent, the payload must not be waited for
+	oversize := encode(testMagic, Message{"block", nil})
+	binary.BigEndian.PutUint32(oversize[4+commandLength:], MaxMessageSize+1)
+
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"wrong magic", encode(testMagic+1, msg), ErrWrongMagic},
+		{"bad checksum", badChecksum, ErrBadChecksum},
+		{"oversize length", oversize, ErrMessageTooLarge},
+		{"truncated payload", encode(testMagic, msg)[:headerLength+4], io.ErrUnexpectedEOF},
+	}
+	for _, test := range tests {
+		if _, err := ReadMessage(bytes.NewReader(test.data), testMagic); !errors.Is(err, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.want)
+		}
+	}
+
+	if err := WriteMessage(io.Discard, testMagic, Message{"block", make([]byte, MaxMessageSize+1)}); !errors.Is(err, ErrMessageTooLarge) {
+		t.Errorf("writing an oversize payload: got %v, want ErrMessageTooLarge", err)
+	}
+	if err := WriteMessage(io.Discard, testMagic, Message{"averylongcommand", nil}); err == nil {
+		t.Error("writing a command longer than the header field: no error")
+	}
+}
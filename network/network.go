@@ -2,36 +2,41 @@ package network
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
-	"encoding/hex"
+	"errors"
 	"fmt"
-	"io"
-	"io/ioutil"
-	"log"
 	"net"
 	"os"
-	"runtime"
+	"sync"
 	"syscall"
 
 	"github.com/phnaharris/harris-blockchain-token/blockchain"
+	"github.com/phnaharris/harris-blockchain-token/chaincfg"
 	"github.com/vrecan/death"
 )
 
 const (
 	protocol      = "tcp"
-	version       = 1
 	commandLength = 12
 )
 
 var (
-	nodeAddress     string
-	minerAddress    string
-	KnownNodes      = []string{"localhost:3000"} // online node -- KnownNode[0] is the genesis node
-	blocksInTransit = [][]byte{}
-	memoryPool      = make(map[string]blockchain.Transaction)
-	maxMemPool      = 2
+	netParams    = &chaincfg.MainNetParams
+	nodeAddress  string
+	minerAddress string
+	memoryPool   = newMemPool()
+	maxMemPool   = 2
+
+	// one goroutine mines the memory pool, it is woken up by mineSignal
+	mineSignal   = make(chan struct{}, 1)
+	miningMutex  sync.Mutex
+	cancelMining = func() {} // stops the block being mined, if any
+	tipChanges   uint64      // tip changes seen by ProcessBlock, a template of an older tip is stale
 )
 
+var ErrMalformedMessage = errors.New("malformed message")
+
 type Addr struct {
 	AddrList []string
 }
@@ -63,9 +68,21 @@ type Tx struct {
 }
 
 type Version struct {
-	Version    int
-	BestHeight int
-	AddrFrom   string
+	Version     int    // protocol version of the sender
+	Services    uint64 // what the sender serves, SFNodeNetwork bits
+	Nonce       uint64 // random, detects connections to self
+	UserAgent   string
+	StartHeight int // best height of the sender
+	AddrFrom    string
+}
+
+type Verack struct{}
+
+// SetParams selects the network to join, its seed nodes start the address
+// book.
+func SetParams(params *chaincfg.Params) {
+	netParams = params
+	manager = NewPeerManager(params.SeedNodes)
 }
 
 func CmdToBytes(cmd string) []byte {
@@ -90,383 +107,475 @@ func BytesToCmd(bytes []byte) string {
 	return fmt.Sprintf("%s", cmd)
 }
 
-func ExtractCmd(request []byte) []byte {
-	return request[:commandLength]
-}
+// send function : send request to address => address: target
+// handle function : receive data from the peer that sent it, replies go back
+// to the same peer
 
-func RequestBlocks() {
-	for _, node := range KnownNodes {
-		SendGetBlocks(node)
-	}
+func SendAddr(address string) error {
+	return sendMessage(address, "addr", Addr{addressList()})
 }
 
-// send function : send request to address => address: target
-// handle function : receive data from send function => addrFrom: source of send = target of handle
+// addressList lists the address book for addr messages.
+func addressList() []string {
+	var list []string
+	for _, ka := range manager.Addresses() {
+		list = append(list, ka.Addr)
+	}
 
-func SendAddr(address string) {
-	addr := Addr{KnownNodes}
-	payload := GobEncode(addr)
-	request := append(CmdToBytes("addr"), payload...)
-	SendData(address, request)
+	return list
 }
 
-func SendBlock(address string, _block *blockchain.Block) {
-	block := Block{nodeAddress, _block.Serialize()}
-	payload := GobEncode(block)
-	request := append(CmdToBytes("block"), payload...)
-	SendData(address, request)
+func SendBlock(address string, _block *blockchain.Block) error {
+	return sendMessage(address, "block", Block{nodeAddress, _block.Serialize()})
 }
 
-func SendData(addr string, data []byte) {
-	conn, err := net.Dial(protocol, addr)
+// sendMessage sends payload as command to the peer at address, which is
+// connected first if needed.
+func sendMessage(address, command string, payload interface{}) error {
+	p, err := ConnectPeer(address)
 	if err != nil {
-		fmt.Printf("%s is not available!\n", addr)
-
-		// update online node
-		var updatedNodes []string
-		for _, node := range KnownNodes {
-			if node != addr {
-				updatedNodes = append(updatedNodes, node)
-			}
-		}
-		KnownNodes = updatedNodes
-		return
+		return err
 	}
 
-	defer conn.Close()
-	_, err = io.Copy(conn, bytes.NewReader(data))
-	Handle(err)
+	return p.Send(command, payload)
+}
+
+func SendInv(address, kind string, items [][]byte) error {
+	return sendMessage(address, "inv", Inv{nodeAddress, kind, items})
 }
 
-func SendInv(address, kind string, items [][]byte) {
-	inventory := Inv{nodeAddress, kind, items}
-	payload := GobEncode(inventory)
-	request := append(CmdToBytes("inv"), payload...)
-	SendData(address, request)
+func SendGetBlocks(address string) error {
+	return sendMessage(address, "getblocks", GetBlocks{nodeAddress})
 }
 
-func SendGetBlocks(address string) {
-	getBlocks := GetBlocks{nodeAddress}
-	payload := GobEncode(getBlocks)
-	request := append(CmdToBytes("getblocks"), payload...)
-	SendData(address, request)
+func SendGetData(address, kind string, id []byte) error {
+	return sendMessage(address, "getdata", GetData{nodeAddress, kind, id})
 }
 
-func SendGetData(address, kind string, id []byte) {
-	getData := GetData{nodeAddress, kind, id}
-	payload := GobEncode(getData)
-	request := append(CmdToBytes("getdata"), payload...)
-	SendData(address, request)
+func SendTx(address string, txn *blockchain.Transaction) error {
+	return sendMessage(address, "tx", Tx{nodeAddress, txn.Serialize()})
 }
 
-func SendTx(address string, txn *blockchain.Transaction) {
-	tx := Tx{nodeAddress, txn.Serialize()}
-	payload := GobEncode(tx)
-	request := append(CmdToBytes("tx"), payload...)
-	SendData(address, request)
+// SubmitTx sends a transaction to the first node of the address book that
+// can be reached, the nodes relay it to their peers.
+func SubmitTx(tx *blockchain.Transaction) error {
+	for _, ka := range manager.Addresses() {
+		if err := SendTx(ka.Addr, tx); err != nil {
+			fmt.Printf("%s.\n", err)
+			continue
+		}
+		return nil
+	}
+
+	return ErrNoPeers
 }
 
-func SendVersion(address string, chain *blockchain.Blockchain) {
-	ver := Version{version, chain.GetBestHeight(), nodeAddress}
-	payload := GobEncode(ver)
-	request := append(CmdToBytes("version"), payload...)
-	SendData(address, request)
+// announce sends an inventory to the connected peers but from, the peer it
+// was received from, if any.
+func announce(kind string, items [][]byte, from *Peer) {
+	for _, p := range connectedPeers() {
+		if p == from {
+			continue
+		}
+		if err := p.Send("inv", Inv{nodeAddress, kind, items}); err != nil {
+			fmt.Printf("%s.\n", err)
+		}
+	}
 }
 
-func HandleAddr(request []byte) {
-	var buffer bytes.Buffer
+// decodePayload decodes the payload of a message, which comes from a peer
+// and may be anything.
+func decodePayload(data []byte, payload interface{}) error {
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	if err := decoder.Decode(payload); err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformedMessage, err)
+	}
+
+	return nil
+}
+
+func HandleAddr(p *Peer, data []byte) error {
 	var payload Addr
+	if err := decodePayload(data, &payload); err != nil {
+		return err
+	}
 
-	buffer.Write(request[commandLength:])
-	decoder := gob.NewDecoder(&buffer)
-	err := decoder.Decode(&payload)
-	Handle(err)
+	// the new addresses are dialed by the peer manager
+	if added := manager.AddAddresses(payload.AddrList); added > 0 {
+		fmt.Printf("There are %d known nodes.\n", len(manager.Addresses()))
+	}
 
-	KnownNodes = append(KnownNodes, payload.AddrList...)
-	fmt.Printf("There are %d known nodes.\n", len(KnownNodes))
-	RequestBlocks()
+	return nil
 }
 
-func HandleBlock(request []byte, chain *blockchain.Blockchain) {
-	var buffer bytes.Buffer
+func HandleBlock(p *Peer, data []byte, chain *blockchain.Blockchain) error {
 	var payload Block
-
-	buffer.Write(request[commandLength:])
-	decoder := gob.NewDecoder(&buffer)
-	err := decoder.Decode(&payload)
-	Handle(err)
+	if err := decodePayload(data, &payload); err != nil {
+		return err
+	}
 
 	blockData := payload.Block
-	block := blockchain.DeserializeBlock(blockData)
+	block, err := blockchain.DeserializeBlock(blockData)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformedMessage, err)
+	}
 
 	fmt.Printf("Receive a block!\n")
-	chain.AddBlock(block)
-	fmt.Printf("Added block: %x.\n", block.Hash)
+	if _, err := ProcessBlock(chain, block); err != nil {
+		fmt.Printf("Rejected block %x: %s.\n", block.Hash, err)
+	}
 
-	// đoạn này chưa hiểu lắm nhưng thôi để làm sau vậy --> vẽ luồng chạy của code ra giấy sẽ hiểu
-	if len(blocksInTransit) > 0 {
-		blockHash := blocksInTransit[0]
-		SendGetData(payload.AddrFrom, "block", blockHash)
-		blocksInTransit = blocksInTransit[1:]
-	} else {
-		UTXOSet := blockchain.UTXOSet{Chain: chain}
-		UTXOSet.Reindex()
+	if len(p.blocksInTransit) > 0 {
+		blockHash := p.blocksInTransit[0]
+		p.blocksInTransit = p.blocksInTransit[1:]
+		return p.Send("getdata", GetData{nodeAddress, "block", blockHash})
 	}
 
-	// -----------------------------------------------
+	return nil
 }
 
-func HandleInv(request []byte, chain *blockchain.Blockchain) {
-	var buffer bytes.Buffer
-	var payload Inv
+// ProcessBlock adds a block received from a peer or submitted by a miner to
+// the chain. When the tip changes the block being mined is dropped and the
+// memory pool follows the new chain.
+func ProcessBlock(chain *blockchain.Blockchain, block *blockchain.Block) (*blockchain.TipChange, error) {
+	change, err := chain.AddBlock(block)
+	if err != nil {
+		return nil, err
+	}
 
-	buffer.Write(request[commandLength:])
-	decoder := gob.NewDecoder(&buffer)
-	err := decoder.Decode(&payload)
-	Handle(err)
+	fmt.Printf("Added block: %x.\n", block.Hash)
+	if len(change.Disconnected) > 0 {
+		fmt.Printf("Reorganized chain: %d blocks disconnected, %d connected.\n", len(change.Disconnected), len(change.Connected))
+	}
+	if len(change.Connected) > 0 {
+		// the block being mined builds on a replaced tip
+		miningMutex.Lock()
+		tipChanges++
+		cancelMining()
+		miningMutex.Unlock()
+
+		UpdateMemPool(chain, change)
+		if memoryPool.Count() > 0 {
+			wakeMiner()
+		}
+	}
+
+	return change, nil
+}
+
+func HandleInv(p *Peer, data []byte, chain *blockchain.Blockchain) error {
+	var payload Inv
+	if err := decodePayload(data, &payload); err != nil {
+		return err
+	}
 
 	fmt.Printf("Received inventory with %d %s.\n", len(payload.Items), payload.Type)
+	if len(payload.Items) == 0 {
+		return nil
+	}
 
 	if payload.Type == "block" {
-		blocksInTransit = payload.Items
-		blockHash := payload.Items[0]
-		SendGetData(payload.AddrFrom, "block", blockHash)
+		// inventory is listed from the tip down, request parents first
+		inTransit := [][]byte{}
+		for i := len(payload.Items) - 1; i >= 0; i-- {
+			inTransit = append(inTransit, payload.Items[i])
+		}
+		blockHash := inTransit[0]
 
-		newInTransit := [][]byte{}
-		for _, b := range blocksInTransit {
+		p.blocksInTransit = [][]byte{}
+		for _, b := range inTransit {
 			if !bytes.Equal(b, blockHash) {
-				newInTransit = append(newInTransit, b)
+				p.blocksInTransit = append(p.blocksInTransit, b)
 			}
 		}
-		blocksInTransit = newInTransit
+
+		return p.Send("getdata", GetData{nodeAddress, "block", blockHash})
 	}
 
 	if payload.Type == "tx" {
 		txID := payload.Items[0]
-		if len(memoryPool[hex.EncodeToString(txID)].ID) == 0 {
-			SendGetData(payload.AddrFrom, "tx", txID)
+		if _, ok := memoryPool.Get(txID); !ok {
+			return p.Send("getdata", GetData{nodeAddress, "tx", txID})
 		}
 	}
+
+	return nil
 }
 
-func HandleGetBlocks(request []byte, chain *blockchain.Blockchain) {
-	var buffer bytes.Buffer
+func HandleGetBlocks(p *Peer, data []byte, chain *blockchain.Blockchain) error {
 	var payload GetBlocks
+	if err := decodePayload(data, &payload); err != nil {
+		return err
+	}
 
-	buffer.Write(request[commandLength:])
-	decoder := gob.NewDecoder(&buffer)
-	err := decoder.Decode(&payload)
-	Handle(err)
+	blocks, err := chain.GetBlockHashes()
+	if err != nil {
+		return err
+	}
 
-	blocks := chain.GetBlockHashes()
-	SendInv(payload.AddrFrom, "block", blocks)
+	return p.Send("inv", Inv{nodeAddress, "block", blocks})
 }
 
-func HandleGetData(request []byte, chain *blockchain.Blockchain) {
-	var buffer bytes.Buffer
+func HandleGetData(p *Peer, data []byte, chain *blockchain.Blockchain) error {
 	var payload GetData
-
-	buffer.Write(request[commandLength:])
-	decoder := gob.NewDecoder(&buffer)
-	err := decoder.Decode(&payload)
-	Handle(err)
+	if err := decodePayload(data, &payload); err != nil {
+		return err
+	}
 
 	if payload.Type == "block" {
 		block, err := chain.GetBlock(payload.ID)
-		Handle(err)
-		SendBlock(payload.AddrFrom, &block)
+		if err != nil {
+			return err
+		}
+		return p.Send("block", Block{nodeAddress, block.Serialize()})
 	}
 
 	if payload.Type == "tx" {
-		txID := hex.EncodeToString(payload.ID)
-		tx := memoryPool[txID]
-		SendTx(payload.AddrFrom, &tx)
+		tx, ok := memoryPool.Get(payload.ID)
+		if !ok {
+			return fmt.Errorf("%w: %x", blockchain.ErrTxNotFound, payload.ID)
+		}
+		return p.Send("tx", Tx{nodeAddress, tx.Serialize()})
 	}
+
+	return nil
 }
 
-func HandleTx(request []byte, chain *blockchain.Blockchain) {
-	var buffer bytes.Buffer
+func HandleTx(p *Peer, data []byte, chain *blockchain.Blockchain) error {
 	var payload Tx
-
-	buffer.Write(request[commandLength:])
-	decoder := gob.NewDecoder(&buffer)
-	err := decoder.Decode(&payload)
-	Handle(err)
+	if err := decodePayload(data, &payload); err != nil {
+		return err
+	}
 
 	txData := payload.Transaction
-	tx := blockchain.DeserializeTransaction(txData)
-	memoryPool[hex.EncodeToString(tx.ID)] = tx
+	tx, err := blockchain.DeserializeTransaction(txData)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformedMessage, err)
+	}
+	if !memoryPool.Add(tx) {
+		return nil
+	}
 
-	fmt.Printf("Memory Pool of %s have %d transactions.\n", nodeAddress, len(memoryPool))
+	fmt.Printf("Memory Pool of %s have %d transactions.\n", nodeAddress, memoryPool.Count())
 
-	if nodeAddress == KnownNodes[0] { // genesis node
-		for _, node := range KnownNodes {
-			if node != nodeAddress && node != payload.AddrFrom { // not genesis node and miner node
-				fmt.Println("HandleTx", node)
-				SendInv(node, "tx", [][]byte{tx.ID})
-			}
-		}
-	} else {
-		fmt.Println("HandleTx", "Miner: ", minerAddress)
-		fmt.Println("HandleTx", "MemPool: ", len(memoryPool))
-		if len(memoryPool) >= maxMemPool && len(minerAddress) > 0 {
-			fmt.Println("HandleTx", "Mineeee")
-			MineTx(chain)
-		}
+	// every node relays the transactions it learns, the miners mine them
+	announce("tx", [][]byte{tx.ID}, p)
+	if memoryPool.Count() >= maxMemPool {
+		wakeMiner()
 	}
+
+	return nil
 }
 
-func Handle(err error) {
-	if err != nil {
-		log.Panic(err)
+// wakeMiner makes the mining goroutine mine the memory pool, if the node
+// mines.
+func wakeMiner() {
+	select {
+	case mineSignal <- struct{}{}:
+	default:
+		// it is woken up already
 	}
 }
 
-func MineTx(chain *blockchain.Blockchain) {
-	var txs []*blockchain.Transaction
-
-	for id := range memoryPool {
-		fmt.Printf("Tx: %s.\n", memoryPool[id].ID)
-		tx := memoryPool[id]
-		if chain.VerifyTransaction(&tx) {
-			txs = append(txs, &tx)
+// mineLoop mines the memory pool each time it is woken up, until the pool is
+// empty or has no valid transaction. It is the only goroutine mining blocks
+// of the node.
+func mineLoop(chain *blockchain.Blockchain) {
+	for range mineSignal {
+		for memoryPool.Count() > 0 {
+			if !MineTx(chain) {
+				break
+			}
 		}
 	}
+}
 
-	if len(txs) == 0 {
-		fmt.Println("All transactions are invalid!")
-		return
-	}
+// MineTx mines a block of the memory pool on top of the tip. It returns true
+// if the block was added or its tip was replaced meanwhile, false if there is
+// nothing to mine or the block cannot be mined.
+func MineTx(chain *blockchain.Blockchain) bool {
+	miningMutex.Lock()
+	tip := tipChanges
+	miningMutex.Unlock()
 
-	cbTx := blockchain.CoinbaseTx(minerAddress, "")
-	txs = append(txs, cbTx)
+	template, err := chain.NewBlockTemplate(MemPoolTxs(), minerAddress)
+	if err != nil {
+		fmt.Printf("Cannot build block template: %s.\n", err)
+		return false
+	}
 
-	newBlock := chain.MineBlock(txs)
-	UTXOSet := blockchain.UTXOSet{Chain: chain}
-	UTXOSet.Reindex()
+	if len(template.Block.Transaction) == 1 {
+		fmt.Println("All transactions are invalid!")
+		return false
+	}
 
-	fmt.Println("New block was mined!")
+	for _, tx := range template.Block.Transaction[1:] {
+		fmt.Printf("Tx: %x.\n", tx.ID)
+	}
 
-	for _, tx := range txs {
-		delete(memoryPool, hex.EncodeToString(tx.ID))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	miningMutex.Lock()
+	if tip != tipChanges {
+		// the tip changed while the template was built
+		miningMutex.Unlock()
+		return true
 	}
+	cancelMining = cancel
+	miningMutex.Unlock()
 
-	for _, node := range KnownNodes {
-		if node != nodeAddress {
-			SendInv(node, "block", [][]byte{newBlock.Hash})
-		}
+	newBlock := template.Block
+	if err := chain.Engine.Seal(ctx, newBlock); err != nil {
+		fmt.Printf("Mining stopped: %s.\n", err)
+		return errors.Is(err, context.Canceled)
 	}
 
-	if len(memoryPool) > 0 {
-		MineTx(chain)
+	if _, err := chain.AddBlock(newBlock); err != nil {
+		fmt.Printf("Mined block was rejected: %s.\n", err)
+		return false
 	}
+
+	fmt.Println("New block was mined!")
+
+	memoryPool.RemoveBlock(newBlock)
+	announce("block", [][]byte{newBlock.Hash}, nil)
+
+	return true
 }
 
-func HandleVersion(request []byte, chain *blockchain.Blockchain) {
-	var buffer bytes.Buffer
-	var payload Version
+// MemPoolTxs lists the transactions of the memory pool.
+func MemPoolTxs() []*blockchain.Transaction {
+	return memoryPool.Txs()
+}
 
-	buffer.Write(request[commandLength:])
-	decoder := gob.NewDecoder(&buffer)
-	err := decoder.Decode(&payload)
-	Handle(err)
+// UpdateMemPool drops transactions that were mined in connected blocks or
+// spend outputs those blocks spent, and gives back transactions of
+// disconnected blocks that are still spendable.
+func UpdateMemPool(chain *blockchain.Blockchain, change *blockchain.TipChange) {
+	UTXOSet := blockchain.UTXOSet{Chain: chain}
 
-	bestHeight := chain.GetBestHeight()
-	otherHeight := payload.BestHeight
+	for _, block := range change.Disconnected {
+		for _, tx := range block.Transaction {
+			if tx.IsCoinbase() {
+				continue
+			}
 
-	if bestHeight > otherHeight {
-		SendVersion(payload.AddrFrom, chain)
-	} else if bestHeight < otherHeight {
-		SendGetBlocks(payload.AddrFrom)
+			spendable := true
+			for _, in := range tx.Inputs {
+				if _, err := UTXOSet.FindOutput(in.ID, in.Out); err != nil {
+					spendable = false
+					break
+				}
+			}
+			if spendable {
+				memoryPool.Add(*tx)
+			}
+		}
 	}
 
-	if !NodeIsKnown(payload.AddrFrom) {
-		KnownNodes = append(KnownNodes, payload.AddrFrom)
+	for _, block := range change.Connected {
+		memoryPool.RemoveBlock(block)
+	}
+	if len(change.Connected) > 0 {
+		memoryPool.RemoveConflicts(func(txID []byte, out int) bool {
+			_, err := UTXOSet.FindEntry(txID, out)
+			return !errors.Is(err, blockchain.ErrMissingInput)
+		})
 	}
 }
 
-func HandleConnection(conn net.Conn, chain *blockchain.Blockchain) {
-	request, err := ioutil.ReadAll(conn)
-	defer conn.Close()
-
-	Handle(err)
-
-	command := BytesToCmd(request[:commandLength])
-	fmt.Printf("Received %s command!\n", command)
+// handleMessage handles a message of a peer with the chain of the node.
+func handleMessage(p *Peer, msg Message) error {
+	chain := nodeChain
+	if chain == nil {
+		return errors.New("this process does not run a node")
+	}
 
-	switch command {
+	switch msg.Command {
 	case "addr":
-		HandleAddr(request)
+		return HandleAddr(p, msg.Payload)
 	case "block":
-		HandleBlock(request, chain)
+		return HandleBlock(p, msg.Payload, chain)
 	case "inv":
-		HandleInv(request, chain)
+		return HandleInv(p, msg.Payload, chain)
 	case "getblocks":
-		HandleGetBlocks(request, chain)
+		return HandleGetBlocks(p, msg.Payload, chain)
 	case "getdata":
-		HandleGetData(request, chain)
+		return HandleGetData(p, msg.Payload, chain)
 	case "tx":
-		HandleTx(request, chain)
-	case "version":
-		HandleVersion(request, chain)
+		return HandleTx(p, msg.Payload, chain)
 	default:
 		fmt.Println("Unknown command!")
+		return nil
 	}
 }
 
-func StartServer(nodeID, _minerAddress string) {
+func StartServer(nodeID, _minerAddress string, engine blockchain.Engine) error {
 	nodeAddress = fmt.Sprintf("localhost:%s", nodeID)
 	minerAddress = _minerAddress
 	ln, err := net.Listen(protocol, nodeAddress)
-	Handle(err)
+	if err != nil {
+		return err
+	}
 	defer ln.Close()
 
-	chain := blockchain.ContinueBlockchain(nodeID)
+	chain, err := blockchain.ContinueBlockchain(nodeID, netParams, engine)
+	if err != nil {
+		return err
+	}
 	defer chain.Database.Close()
 	go CloseDB(chain)
+	nodeChain = chain
+	if len(minerAddress) > 0 {
+		go mineLoop(chain)
+	}
+	defer DisconnectPeers()
+
+	rpcAddress, err := RPCAddress(nodeID)
+	if err != nil {
+		return err
+	}
+	rpcLn, err := StartRPCServer(rpcAddress, chain)
+	if err != nil {
+		return err
+	}
+	defer rpcLn.Close()
 
-	if nodeAddress != KnownNodes[0] {
-		SendVersion(KnownNodes[0], chain)
+	// the peer manager dials the known nodes, the handshake asks them for
+	// the blocks the node misses
+	if err := LoadAddressBook(nodeID); err != nil {
+		return err
 	}
+	manager.Start()
+	defer manager.Stop()
 
 	for {
 		conn, err := ln.Accept()
-		Handle(err)
-		go HandleConnection(conn, chain)
+		if err != nil {
+			return err
+		}
+		go HandleConnection(conn)
 	}
 }
 
-func GobEncode(data interface{}) []byte {
+func GobEncode(data interface{}) ([]byte, error) {
 	var buffer bytes.Buffer
 	encoder := gob.NewEncoder(&buffer)
 	err := encoder.Encode(data)
-	Handle(err)
-	return buffer.Bytes()
-}
-
-// func GobDecode(data []byte) interface{} {
-// 	var res interface{}
-// 	decoder := gob.NewDecoder(bytes.NewReader(data))
-// 	err := decoder.Decode(res)
-// 	Handle(err)
-// 	fmt.Println("GobDecode ", res)
-// 	return res
-// }
-
-func NodeIsKnown(addr string) bool {
-	for _, node := range KnownNodes {
-		if node == addr {
-			return true
-		}
-	}
-	return false
+	return buffer.Bytes(), err
 }
 
+// CloseDB closes the database when the node is interrupted.
 func CloseDB(chain *blockchain.Blockchain) {
 	d := death.NewDeath(syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
 	d.WaitForDeathWithFunc(func() {
-		defer os.Exit(1)
-		defer runtime.Goexit()
-		chain.Database.Close()
+		if err := manager.Stop(); err != nil {
+			fmt.Printf("Cannot save the address book: %s.\n", err)
+		}
+		DisconnectPeers()
+		if err := chain.Database.Close(); err != nil {
+			fmt.Printf("Cannot close the database: %s.\n", err)
+		}
+		os.Exit(1)
 	})
 }
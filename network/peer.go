@@ -0,0 +1,310 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/phnaharris/harris-blockchain-token/blockchain"
+)
+
+const (
+	sendQueueSize = 64
+
+	dialTimeout  = 10 * time.Second
+	writeTimeout = time.Minute
+	// a peer sending nothing for readTimeout is disconnected, the
+	// connection is dialed again by the next message for it
+	readTimeout = 10 * time.Minute
+)
+
+var ErrPeerDisconnected = errors.New("peer is disconnected")
+
+var (
+	peersMutex sync.Mutex
+	peers      = make(map[string]*Peer) // connected peers by address
+
+	// nodeChain handles the messages of peers, it is nil in processes
+	// that only send messages
+	nodeChain *blockchain.Blockchain
+)
+
+// Peer is a long-lived connection to another node, messages are read and
+// written by two goroutines of their own.
+type Peer struct {
+	addr    string // listen address of the node, the remote address for inbound peers until it is known
+	inbound bool
+
+	conn        net.Conn
+	connectedAt time.Time
+	send        chan Message
+	ready       chan struct{} // closed when the handshake is done
+	quit        chan struct{} // closed when the peer is disconnected
+	done        chan struct{} // closed when the queued messages are written and conn is closed
+
+	closeOnce sync.Once
+
+	// handshake state, used by the read goroutine only
+	versionReceived   bool
+	verackReceived    bool
+	handshakeDeadline time.Time
+
+	// blocks announced by the peer that are still to be requested, parents
+	// first, used by the read goroutine only
+	blocksInTransit [][]byte
+
+	mu              sync.Mutex
+	version         Version // version message of the peer
+	protocolVersion int
+}
+
+func newPeer(conn net.Conn, addr string, inbound bool) *Peer {
+	return &Peer{
+		addr:              addr,
+		inbound:           inbound,
+		conn:              conn,
+		connectedAt:       time.Now(),
+		send:              make(chan Message, sendQueueSize),
+		ready:             make(chan struct{}),
+		quit:              make(chan struct{}),
+		done:              make(chan struct{}),
+		handshakeDeadline: time.Now().Add(handshakeTimeout),
+	}
+}
+
+// Addr returns the address the peer is known by.
+func (p *Peer) Addr() string {
+	peersMutex.Lock()
+	defer peersMutex.Unlock()
+
+	return p.addr
+}
+
+func (p *Peer) Inbound() bool {
+	return p.inbound
+}
+
+// ConnectPeer returns the peer connected at addr, the connection is dialed
+// if there is none. A failed dial is recorded in the address book.
+func ConnectPeer(addr string) (*Peer, error) {
+	peersMutex.Lock()
+	p, ok := peers[addr]
+	peersMutex.Unlock()
+	if ok {
+		return p, nil
+	}
+
+	conn, err := net.DialTimeout(protocol, addr, dialTimeout)
+	if err != nil {
+		manager.Failed(addr)
+		return nil, fmt.Errorf("%s is not available: %w", addr, err)
+	}
+
+	peersMutex.Lock()
+	// another goroutine may have connected meanwhile
+	if other, ok := peers[addr]; ok {
+		peersMutex.Unlock()
+		conn.Close()
+		return other, nil
+	}
+	p = newPeer(conn, addr, false)
+	peers[addr] = p
+	peersMutex.Unlock()
+
+	p.start()
+	if err := p.sendVersion(); err != nil {
+		p.Disconnect()
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// HandleConnection serves a connection accepted by the node until it is
+// closed, connections over the inbound limit are refused.
+func HandleConnection(conn net.Conn) {
+	if inbound, _ := countPeers(); inbound >= manager.MaxInbound {
+		fmt.Printf("Refused %s: %s.\n", conn.RemoteAddr(), ErrTooManyPeers)
+		conn.Close()
+		return
+	}
+	p := newPeer(conn, conn.RemoteAddr().String(), true)
+
+	peersMutex.Lock()
+	peers[p.addr] = p
+	peersMutex.Unlock()
+
+	go p.writeLoop()
+	p.readLoop()
+}
+
+// setPeerAddr makes an inbound peer known by the listen address it gave, so
+// that messages for that address use its connection.
+func setPeerAddr(p *Peer, addr string) {
+	peersMutex.Lock()
+	defer peersMutex.Unlock()
+
+	if len(addr) == 0 || p.addr == addr || peers[addr] != nil || peers[p.addr] != p {
+		return
+	}
+	delete(peers, p.addr)
+	p.addr = addr
+	peers[addr] = p
+}
+
+func (p *Peer) start() {
+	go p.writeLoop()
+	go p.readLoop()
+}
+
+// Send encodes payload and queues it as command for the peer, once the
+// handshake is done.
+func (p *Peer) Send(command string, payload interface{}) error {
+	timeout := time.NewTimer(handshakeTimeout)
+	defer timeout.Stop()
+
+	select {
+	case <-p.ready:
+	case <-p.quit:
+		return fmt.Errorf("%w: %s", ErrPeerDisconnected, p.Addr())
+	case <-timeout.C:
+		return fmt.Errorf("%w: %s", ErrHandshakeTimeout, p.Addr())
+	}
+
+	return p.queue(command, payload)
+}
+
+func (p *Peer) queue(command string, payload interface{}) error {
+	data, err := GobEncode(payload)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case p.send <- Message{command, data}:
+		return nil
+	case <-p.quit:
+		return fmt.Errorf("%w: %s", ErrPeerDisconnected, p.Addr())
+	}
+}
+
+// Disconnect closes the connection once the queued messages are written.
+func (p *Peer) Disconnect() {
+	p.closeOnce.Do(func() {
+		close(p.quit)
+
+		peersMutex.Lock()
+		addr := p.addr
+		if peers[addr] == p {
+			delete(peers, addr)
+		}
+		peersMutex.Unlock()
+
+		// the node was seen until now
+		if p.handshakeDone() && manager.Known(addr) {
+			manager.Good(addr)
+		}
+	})
+}
+
+// DisconnectPeers disconnects every peer and waits until their queued
+// messages are written.
+func DisconnectPeers() {
+	peersMutex.Lock()
+	var all []*Peer
+	for _, p := range peers {
+		all = append(all, p)
+	}
+	peersMutex.Unlock()
+
+	for _, p := range all {
+		p.Disconnect()
+	}
+	for _, p := range all {
+		<-p.done
+	}
+}
+
+func (p *Peer) readLoop() {
+	for {
+		deadline := time.Now().Add(readTimeout)
+		if !p.handshakeDone() && p.handshakeDeadline.Before(deadline) {
+			deadline = p.handshakeDeadline
+		}
+		if err := p.conn.SetReadDeadline(deadline); err != nil {
+			p.Disconnect()
+			return
+		}
+
+		msg, err := ReadMessage(p.conn, netParams.Magic)
+		if err != nil {
+			select {
+			case <-p.quit:
+			default:
+				if err != io.EOF {
+					fmt.Printf("Disconnecting %s: %s.\n", p.Addr(), err)
+				}
+			}
+			p.Disconnect()
+			return
+		}
+
+		fmt.Printf("Received %s command!\n", msg.Command)
+		if msg.Command == "version" || msg.Command == "verack" {
+			if err := p.handleHandshake(msg); err != nil {
+				fmt.Printf("Disconnecting %s: %s.\n", p.Addr(), err)
+				p.Disconnect()
+				return
+			}
+			continue
+		}
+		if !p.handshakeDone() {
+			fmt.Printf("Disconnecting %s: %s: %s.\n", p.Addr(), ErrHandshakeRequired, msg.Command)
+			p.Disconnect()
+			return
+		}
+
+		if err := handleMessage(p, msg); err != nil {
+			fmt.Printf("Cannot handle %s command: %s.\n", msg.Command, err)
+		}
+	}
+}
+
+func (p *Peer) writeLoop() {
+	defer close(p.done)
+	defer p.conn.Close()
+
+	for {
+		select {
+		case msg := <-p.send:
+			if err := p.write(msg); err != nil {
+				fmt.Printf("Disconnecting %s: %s.\n", p.Addr(), err)
+				p.Disconnect()
+				return
+			}
+		case <-p.quit:
+			// write what was queued before the peer was disconnected
+			for {
+				select {
+				case msg := <-p.send:
+					if err := p.write(msg); err != nil {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (p *Peer) write(msg Message) error {
+	if err := p.conn.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+		return err
+	}
+
+	return WriteMessage(p.conn, netParams.Magic, msg)
+}
@@ -0,0 +1,443 @@
+package network
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	addressBookFile = "%s/peers_%s.data"
+
+	DefaultMaxInbound  = 32
+	DefaultMaxOutbound = 8
+
+	// a node that cannot be dialed is tried again after minRetryDelay,
+	// doubled after every failure up to maxRetryDelay
+	minRetryDelay = 5 * time.Second
+	maxRetryDelay = 10 * time.Minute
+	// addresses failing maxFailures dials in a row are forgotten, unless
+	// they were added with addnode
+	maxFailures = 16
+
+	connectInterval = 5 * time.Second
+	maxAddresses    = 1000
+)
+
+var (
+	ErrTooManyPeers = errors.New("too many peers")
+	ErrNoPeers      = errors.New("no node can be reached")
+	ErrUnknownPeer  = errors.New("node is neither connected nor known")
+)
+
+// KnownAddress is an address of the address book with what is known about
+// the node listening at it.
+type KnownAddress struct {
+	Addr        string
+	LastSeen    time.Time // last time the node was connected
+	LastAttempt time.Time // last failed dial
+	Failures    int       // failed dials since the node was last connected
+	Persistent  bool      // added with addnode, kept connected
+}
+
+// retryTime is when the address can be dialed again.
+func (ka *KnownAddress) retryTime() time.Time {
+	if ka.Failures == 0 {
+		return time.Time{}
+	}
+
+	delay := maxRetryDelay
+	if ka.Failures < 32 {
+		if d := minRetryDelay << (ka.Failures - 1); d < maxRetryDelay {
+			delay = d
+		}
+	}
+
+	return ka.LastAttempt.Add(delay)
+}
+
+// PeerManager keeps the address book of the node and its outbound
+// connections: it dials the known nodes until MaxOutbound peers are
+// connected, waiting longer after every failed dial of a node.
+type PeerManager struct {
+	MaxInbound  int
+	MaxOutbound int
+
+	mu    sync.Mutex
+	addrs map[string]*KnownAddress
+	path  string // file the address book is saved to, none if empty
+	dirty bool
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// manager is the peer manager of the node, SetParams starts it with the seed
+// nodes of the network.
+var manager = NewPeerManager(netParams.SeedNodes)
+
+func NewPeerManager(seeds []string) *PeerManager {
+	m := &PeerManager{
+		MaxInbound:  DefaultMaxInbound,
+		MaxOutbound: DefaultMaxOutbound,
+		addrs:       make(map[string]*KnownAddress),
+	}
+	m.AddAddresses(seeds)
+
+	return m
+}
+
+// LoadAddressBook reads the address book of a node, the addresses learned
+// from now on are saved to it.
+func LoadAddressBook(nodeID string) error {
+	return manager.Load(fmt.Sprintf(addressBookFile, netParams.DataDir, nodeID))
+}
+
+// Load merges the address book saved at path, which may not exist yet, and
+// saves to it from now on.
+func (m *PeerManager) Load(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.path = path
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var saved []KnownAddress
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&saved); err != nil {
+		return fmt.Errorf("address book %s: %w", path, err)
+	}
+	for i := range saved {
+		ka := saved[i]
+		if old, ok := m.addrs[ka.Addr]; ok {
+			ka.Persistent = ka.Persistent || old.Persistent
+		}
+		m.addrs[ka.Addr] = &ka
+	}
+
+	return nil
+}
+
+// Save writes the address book if it changed since it was last saved.
+func (m *PeerManager) Save() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.path) == 0 || !m.dirty {
+		return nil
+	}
+
+	saved := make([]KnownAddress, 0, len(m.addrs))
+	for _, ka := range m.addrs {
+		saved = append(saved, *ka)
+	}
+
+	var content bytes.Buffer
+	if err := gob.NewEncoder(&content).Encode(saved); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(m.path), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(m.path, content.Bytes(), 0644); err != nil {
+		return err
+	}
+	m.dirty = false
+
+	return nil
+}
+
+// AddAddresses adds the addresses that are not in the address book yet.
+func (m *PeerManager) AddAddresses(addrs []string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	added := 0
+	for _, addr := range addrs {
+		if len(addr) == 0 || addr == nodeAddress || m.addrs[addr] != nil || len(m.addrs) >= maxAddresses {
+			continue
+		}
+		m.addrs[addr] = &KnownAddress{Addr: addr}
+		added++
+	}
+	if added > 0 {
+		m.dirty = true
+	}
+
+	return added
+}
+
+// AddNode adds an address that is kept connected and never forgotten.
+func (m *PeerManager) AddNode(addr string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ka, ok := m.addrs[addr]
+	if !ok {
+		ka = &KnownAddress{Addr: addr}
+		m.addrs[addr] = ka
+	}
+	ka.Persistent = true
+	ka.Failures = 0
+	m.dirty = true
+}
+
+// Remove forgets an address.
+func (m *PeerManager) Remove(addr string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.addrs[addr]; !ok {
+		return false
+	}
+	delete(m.addrs, addr)
+	m.dirty = true
+
+	return true
+}
+
+// Known tells if addr is in the address book.
+func (m *PeerManager) Known(addr string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.addrs[addr] != nil
+}
+
+// Good records that the node at addr is connected.
+func (m *PeerManager) Good(addr string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ka, ok := m.addrs[addr]
+	if !ok {
+		if len(addr) == 0 || addr == nodeAddress || len(m.addrs) >= maxAddresses {
+			return
+		}
+		ka = &KnownAddress{Addr: addr}
+		m.addrs[addr] = ka
+	}
+	ka.LastSeen = time.Now()
+	ka.Failures = 0
+	m.dirty = true
+}
+
+// Failed records a failed dial of addr, the address is forgotten after
+// maxFailures in a row.
+func (m *PeerManager) Failed(addr string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ka, ok := m.addrs[addr]
+	if !ok {
+		return
+	}
+	ka.LastAttempt = time.Now()
+	ka.Failures++
+	if ka.Failures >= maxFailures && !ka.Persistent {
+		delete(m.addrs, addr)
+	}
+	m.dirty = true
+}
+
+// Addresses lists the address book, the nodes seen last first.
+func (m *PeerManager) Addresses() []KnownAddress {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	addrs := make([]KnownAddress, 0, len(m.addrs))
+	for _, ka := range m.addrs {
+		addrs = append(addrs, *ka)
+	}
+	sort.Slice(addrs, func(i, j int) bool {
+		if !addrs[i].LastSeen.Equal(addrs[j].LastSeen) {
+			return addrs[i].LastSeen.After(addrs[j].LastSeen)
+		}
+		return addrs[i].Addr < addrs[j].Addr
+	})
+
+	return addrs
+}
+
+// candidates lists the addresses to dial now: not connected and not waiting
+// after a failure, the ones added with addnode first.
+func (m *PeerManager) candidates(now time.Time) []string {
+	var persistent, others []string
+	for _, ka := range m.Addresses() {
+		if ka.Addr == nodeAddress || connectedPeer(ka.Addr) != nil || now.Before(ka.retryTime()) {
+			continue
+		}
+		if ka.Persistent {
+			persistent = append(persistent, ka.Addr)
+		} else {
+			others = append(others, ka.Addr)
+		}
+	}
+
+	return append(persistent, others...)
+}
+
+// Start keeps the outbound connections of the node until Stop is called.
+func (m *PeerManager) Start() {
+	m.quit = make(chan struct{})
+	m.wg.Add(1)
+
+	go func() {
+		defer m.wg.Done()
+
+		ticker := time.NewTicker(connectInterval)
+		defer ticker.Stop()
+
+		for {
+			m.connectPeers()
+			if err := m.Save(); err != nil {
+				fmt.Printf("Cannot save the address book: %s.\n", err)
+			}
+
+			select {
+			case <-ticker.C:
+			case <-m.quit:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops connecting peers and saves the address book.
+func (m *PeerManager) Stop() error {
+	if m.quit != nil {
+		close(m.quit)
+		m.wg.Wait()
+		m.quit = nil
+	}
+
+	return m.Save()
+}
+
+func (m *PeerManager) connectPeers() {
+	_, outbound := countPeers()
+
+	for _, addr := range m.candidates(time.Now()) {
+		if outbound >= m.MaxOutbound {
+			return
+		}
+		if _, err := ConnectPeer(addr); err != nil {
+			fmt.Printf("%s.\n", err)
+			continue
+		}
+		outbound++
+	}
+}
+
+// connectedPeer returns the peer connected at addr, nil if there is none.
+func connectedPeer(addr string) *Peer {
+	peersMutex.Lock()
+	defer peersMutex.Unlock()
+
+	return peers[addr]
+}
+
+// connectedPeers lists the peers that finished the handshake.
+func connectedPeers() []*Peer {
+	peersMutex.Lock()
+	defer peersMutex.Unlock()
+
+	var list []*Peer
+	for _, p := range peers {
+		if p.handshakeDone() {
+			list = append(list, p)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].addr < list[j].addr })
+
+	return list
+}
+
+func countPeers() (inbound, outbound int) {
+	peersMutex.Lock()
+	defer peersMutex.Unlock()
+
+	for _, p := range peers {
+		if p.inbound {
+			inbound++
+		} else {
+			outbound++
+		}
+	}
+
+	return inbound, outbound
+}
+
+// PeerInfo describes a connected peer.
+type PeerInfo struct {
+	Addr            string
+	Inbound         bool
+	ConnectedAt     time.Time
+	ProtocolVersion int // zero until the handshake is done
+	UserAgent       string
+	Services        uint64
+	StartHeight     int
+}
+
+// GetPeerInfo describes the connected peers.
+func GetPeerInfo() []PeerInfo {
+	peersMutex.Lock()
+	var list []*Peer
+	for _, p := range peers {
+		list = append(list, p)
+	}
+	peersMutex.Unlock()
+
+	infos := make([]PeerInfo, 0, len(list))
+	for _, p := range list {
+		ver, _ := p.Version()
+		infos = append(infos, PeerInfo{
+			Addr:            p.Addr(),
+			Inbound:         p.inbound,
+			ConnectedAt:     p.connectedAt,
+			ProtocolVersion: p.ProtocolVersion(),
+			UserAgent:       ver.UserAgent,
+			Services:        ver.Services,
+			StartHeight:     ver.StartHeight,
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Addr < infos[j].Addr })
+
+	return infos
+}
+
+// AddNode adds addr to the address book as a node to keep connected and
+// dials it.
+func AddNode(addr string) error {
+	manager.AddNode(addr)
+	_, err := ConnectPeer(addr)
+
+	return err
+}
+
+// DisconnectNode disconnects the peer at addr and forgets the address, the
+// node is dialed again only if it is added back or learned from a peer.
+func DisconnectNode(addr string) error {
+	p := connectedPeer(addr)
+	if p != nil {
+		p.Disconnect()
+	}
+	if !manager.Remove(addr) && p == nil {
+		return fmt.Errorf("%w: %s", ErrUnknownPeer, addr)
+	}
+
+	return nil
+}
@@ -0,0 +1,201 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"strconv"
+
+	"github.com/phnaharris/harris-blockchain-token/blockchain"
+	"github.com/phnaharris/harris-blockchain-token/wallet"
+)
+
+// The RPC server listens on localhost, rpcPortOffset above the node port, so
+// mining processes can run next to the node.
+const (
+	rpcPortOffset = 10000
+	rpcService    = "Node"
+)
+
+var ErrBadMinerAddress = errors.New("miner address is not valid")
+
+func RPCAddress(nodeID string) (string, error) {
+	port, err := strconv.Atoi(nodeID)
+	if err != nil {
+		return "", fmt.Errorf("node ID %q is not a port: %w", nodeID, err)
+	}
+
+	return fmt.Sprintf("localhost:%d", port+rpcPortOffset), nil
+}
+
+type BlockTemplateArgs struct {
+	MinerAddress string
+}
+
+// BlockTemplateReply holds the encoded block to mine, its coinbase pays
+// Subsidy plus Fees to the miner address.
+type BlockTemplateReply struct {
+	Block   []byte
+	Subsidy int
+	Fees    int
+}
+
+type SubmitBlockArgs struct {
+	Block []byte
+}
+
+type SubmitBlockReply struct {
+	Hash   []byte
+	Height int
+}
+
+type PeerInfoArgs struct{}
+
+type PeerInfoReply struct {
+	Peers []PeerInfo
+}
+
+// NodeArgs names a node by the address it listens at.
+type NodeArgs struct {
+	Addr string
+}
+
+type NodeReply struct{}
+
+// NodeRPC is the interface of the node for outside miners.
+type NodeRPC struct {
+	chain *blockchain.Blockchain
+}
+
+// GetBlockTemplate builds a block on the tip from the memory pool.
+func (n *NodeRPC) GetBlockTemplate(args *BlockTemplateArgs, reply *BlockTemplateReply) error {
+	if !wallet.ValidateAddress([]byte(args.MinerAddress), n.chain.Params) {
+		return ErrBadMinerAddress
+	}
+
+	template, err := n.chain.NewBlockTemplate(MemPoolTxs(), args.MinerAddress)
+	if err != nil {
+		return err
+	}
+
+	reply.Block = template.Block.Serialize()
+	reply.Subsidy = template.Subsidy
+	reply.Fees = template.Fees
+
+	return nil
+}
+
+// SubmitBlock adds a mined block to the chain like a block from a peer and
+// announces it to the known nodes.
+func (n *NodeRPC) SubmitBlock(args *SubmitBlockArgs, reply *SubmitBlockReply) error {
+	block, err := blockchain.DeserializeBlock(args.Block)
+	if err != nil {
+		return fmt.Errorf("cannot decode block: %w", err)
+	}
+	if _, err := ProcessBlock(n.chain, block); err != nil {
+		return err
+	}
+
+	announce("block", [][]byte{block.Hash}, nil)
+
+	reply.Hash = block.Hash
+	reply.Height = block.Height
+
+	return nil
+}
+
+// GetPeerInfo describes the connected peers.
+func (n *NodeRPC) GetPeerInfo(args *PeerInfoArgs, reply *PeerInfoReply) error {
+	reply.Peers = GetPeerInfo()
+	return nil
+}
+
+// AddNode adds a node to keep connected, the node is dialed at once.
+func (n *NodeRPC) AddNode(args *NodeArgs, reply *NodeReply) error {
+	return AddNode(args.Addr)
+}
+
+// DisconnectNode disconnects a node and forgets its address.
+func (n *NodeRPC) DisconnectNode(args *NodeArgs, reply *NodeReply) error {
+	return DisconnectNode(args.Addr)
+}
+
+// StartRPCServer serves NodeRPC on address until the returned listener is
+// closed.
+func StartRPCServer(address string, chain *blockchain.Blockchain) (net.Listener, error) {
+	server := rpc.NewServer()
+	if err := server.RegisterName(rpcService, &NodeRPC{chain}); err != nil {
+		return nil, err
+	}
+
+	ln, err := net.Listen(protocol, address)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("RPC server listening on %s.\n", address)
+
+	go server.Accept(ln)
+
+	return ln, nil
+}
+
+// RPCClient calls the RPC server of a node.
+type RPCClient struct {
+	client *rpc.Client
+}
+
+func DialRPC(address string) (*RPCClient, error) {
+	client, err := rpc.Dial(protocol, address)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RPCClient{client}, nil
+}
+
+func (c *RPCClient) GetBlockTemplate(minerAddress string) (*blockchain.Block, *BlockTemplateReply, error) {
+	reply := &BlockTemplateReply{}
+	err := c.client.Call(rpcService+".GetBlockTemplate", &BlockTemplateArgs{minerAddress}, reply)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	block, err := blockchain.DeserializeBlock(reply.Block)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return block, reply, nil
+}
+
+func (c *RPCClient) SubmitBlock(block *blockchain.Block) (*SubmitBlockReply, error) {
+	reply := &SubmitBlockReply{}
+	err := c.client.Call(rpcService+".SubmitBlock", &SubmitBlockArgs{block.Serialize()}, reply)
+	if err != nil {
+		return nil, err
+	}
+
+	return reply, nil
+}
+
+func (c *RPCClient) GetPeerInfo() ([]PeerInfo, error) {
+	reply := &PeerInfoReply{}
+	if err := c.client.Call(rpcService+".GetPeerInfo", &PeerInfoArgs{}, reply); err != nil {
+		return nil, err
+	}
+
+	return reply.Peers, nil
+}
+
+func (c *RPCClient) AddNode(addr string) error {
+	return c.client.Call(rpcService+".AddNode", &NodeArgs{addr}, &NodeReply{})
+}
+
+func (c *RPCClient) DisconnectNode(addr string) error {
+	return c.client.Call(rpcService+".DisconnectNode", &NodeArgs{addr}, &NodeReply{})
+}
+
+func (c *RPCClient) Close() error {
+	return c.client.Close()
+}
@@ -0,0 +1,105 @@
+package storage
+
+import (
+	"github.com/dgraph-io/badger"
+)
+
+// Badger is a KV in a badger database on disk.
+type Badger struct {
+	db *badger.DB
+}
+
+// OpenBadger opens the badger database in the directory path, creating it if
+// needed.
+func OpenBadger(path string) (*Badger, error) {
+	db, err := badger.Open(badger.DefaultOptions(path))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Badger{db}, nil
+}
+
+func (b *Badger) Get(key []byte) ([]byte, error) {
+	var value []byte
+	err := b.db.View(func(txn *badger.Txn) error {
+		var err error
+		value, err = badgerTxn{txn}.Get(key)
+		return err
+	})
+
+	return value, err
+}
+
+func (b *Badger) Iterate(prefix, start []byte, fn func(key, value []byte) bool) error {
+	return b.db.View(func(txn *badger.Txn) error {
+		return badgerTxn{txn}.Iterate(prefix, start, fn)
+	})
+}
+
+func (b *Badger) Put(key, value []byte) error {
+	return b.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(key, value)
+	})
+}
+
+func (b *Badger) Delete(key []byte) error {
+	return b.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(key)
+	})
+}
+
+func (b *Badger) Update(fn func(batch Batch) error) error {
+	return b.db.Update(func(txn *badger.Txn) error {
+		return fn(badgerTxn{txn})
+	})
+}
+
+func (b *Badger) Close() error {
+	return b.db.Close()
+}
+
+// badgerTxn is a Batch over a badger transaction.
+type badgerTxn struct {
+	txn *badger.Txn
+}
+
+func (t badgerTxn) Get(key []byte) ([]byte, error) {
+	item, err := t.txn.Get(key)
+	if err == badger.ErrKeyNotFound {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return item.ValueCopy(nil)
+}
+
+func (t badgerTxn) Iterate(prefix, start []byte, fn func(key, value []byte) bool) error {
+	it := t.txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+
+	if start == nil {
+		start = prefix
+	}
+	for it.Seek(start); it.ValidForPrefix(prefix); it.Next() {
+		value, err := it.Item().ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		if !fn(it.Item().KeyCopy(nil), value) {
+			break
+		}
+	}
+
+	return nil
+}
+
+func (t badgerTxn) Put(key, value []byte) error {
+	return t.txn.Set(key, value)
+}
+
+func (t badgerTxn) Delete(key []byte) error {
+	return t.txn.Delete(key)
+}
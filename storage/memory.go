@@ -0,0 +1,164 @@
+package storage
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Memory is a KV kept in memory, its content is lost on Close.
+type Memory struct {
+	mu     sync.RWMutex
+	values map[string][]byte
+}
+
+func NewMemory() *Memory {
+	return &Memory{values: make(map[string][]byte)}
+}
+
+func (m *Memory) Get(key []byte) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	value, ok := m.values[string(key)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return append([]byte{}, value...), nil
+}
+
+func (m *Memory) Iterate(prefix, start []byte, fn func(key, value []byte) bool) error {
+	// fn runs on a copy of the range so it can use the store
+	keys, values := m.scan(prefix, start, nil)
+	for i := range keys {
+		if !fn(keys[i], values[i]) {
+			break
+		}
+	}
+
+	return nil
+}
+
+// scan returns the keys starting with prefix from start on and their values,
+// in key order, with the changes of pending applied.
+func (m *Memory) scan(prefix, start []byte, pending map[string][]byte) ([][]byte, [][]byte) {
+	if start == nil || bytes.Compare(start, prefix) < 0 {
+		start = prefix
+	}
+
+	m.mu.RLock()
+	var found []string
+	for key := range m.values {
+		if _, ok := pending[key]; !ok {
+			found = append(found, key)
+		}
+	}
+	for key, value := range pending {
+		if value != nil {
+			found = append(found, key)
+		}
+	}
+
+	var keys, values [][]byte
+	sort.Strings(found)
+	for _, key := range found {
+		if !strings.HasPrefix(key, string(prefix)) || key < string(start) {
+			continue
+		}
+		value, ok := pending[key]
+		if !ok {
+			value = m.values[key]
+		}
+		keys = append(keys, []byte(key))
+		values = append(values, append([]byte{}, value...))
+	}
+	m.mu.RUnlock()
+
+	return keys, values
+}
+
+func (m *Memory) Put(key, value []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.values[string(key)] = append([]byte{}, value...)
+	return nil
+}
+
+func (m *Memory) Delete(key []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.values, string(key))
+	return nil
+}
+
+// Update runs fn on a batch buffering its changes, they are applied together
+// once fn returns.
+func (m *Memory) Update(fn func(batch Batch) error) error {
+	batch := &memoryBatch{m, make(map[string][]byte)}
+	if err := fn(batch); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, value := range batch.pending {
+		if value == nil {
+			delete(m.values, key)
+		} else {
+			m.values[key] = value
+		}
+	}
+
+	return nil
+}
+
+func (m *Memory) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.values = make(map[string][]byte)
+	return nil
+}
+
+// memoryBatch keeps the changes of an Update, a nil value is a deletion.
+type memoryBatch struct {
+	store   *Memory
+	pending map[string][]byte
+}
+
+func (b *memoryBatch) Get(key []byte) ([]byte, error) {
+	if value, ok := b.pending[string(key)]; ok {
+		if value == nil {
+			return nil, ErrNotFound
+		}
+		return append([]byte{}, value...), nil
+	}
+
+	return b.store.Get(key)
+}
+
+func (b *memoryBatch) Iterate(prefix, start []byte, fn func(key, value []byte) bool) error {
+	keys, values := b.store.scan(prefix, start, b.pending)
+	for i := range keys {
+		if !fn(keys[i], values[i]) {
+			break
+		}
+	}
+
+	return nil
+}
+
+func (b *memoryBatch) Put(key, value []byte) error {
+	b.pending[string(key)] = append([]byte{}, value...)
+	return nil
+}
+
+func (b *memoryBatch) Delete(key []byte) error {
+	b.pending[string(key)] = nil
+	return nil
+}
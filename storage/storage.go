@@ -0,0 +1,38 @@
+// Package storage is the key-value store under the chain. The blockchain
+// package keeps blocks, the UTXO set and the indexes in a KV, which is a
+// badger database for a node and can be kept in memory for tests and
+// simulations.
+package storage
+
+import "errors"
+
+var ErrNotFound = errors.New("key not found")
+
+// Reader reads keys from a store.
+type Reader interface {
+	// Get returns a copy of the value of key, ErrNotFound if it is not set.
+	Get(key []byte) ([]byte, error)
+	// Iterate calls fn with the keys starting with prefix in byte order,
+	// from start on when start is not nil, until fn returns false. The key
+	// and value are copies fn may keep.
+	Iterate(prefix, start []byte, fn func(key, value []byte) bool) error
+}
+
+// Batch is a set of changes applied atomically. Reads through a batch see
+// its own writes.
+type Batch interface {
+	Reader
+	Put(key, value []byte) error
+	Delete(key []byte) error
+}
+
+// KV is a key-value store.
+type KV interface {
+	Reader
+	Put(key, value []byte) error
+	Delete(key []byte) error
+	// Update applies the changes fn makes to the batch atomically, none of
+	// them when fn returns an error.
+	Update(fn func(batch Batch) error) error
+	Close() error
+}
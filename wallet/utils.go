@@ -1,7 +1,7 @@
 package wallet
 
 import (
-	"log"
+	"fmt"
 
 	"github.com/mr-tron/base58"
 )
@@ -10,10 +10,10 @@ func Base58Encode(data []byte) []byte {
 	return []byte(base58.Encode(data))
 }
 
-func Base58Decode(data []byte) []byte {
+func Base58Decode(data []byte) ([]byte, error) {
 	decode, err := base58.Decode(string(data[:]))
 	if err != nil {
-		log.Panic(err)
+		return nil, fmt.Errorf("%w: %v", ErrInvalidAddress, err)
 	}
-	return []byte(decode)
+	return []byte(decode), nil
 }
@@ -6,27 +6,29 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
-	"log"
+	"errors"
 
+	"github.com/phnaharris/harris-blockchain-token/chaincfg"
 	"golang.org/x/crypto/ripemd160"
 )
 
-const (
-	ChecksumLength = 4
-	version        = byte(0x00)
-)
+const ChecksumLength = 4
+
+var ErrInvalidAddress = errors.New("address is not valid")
 
 type Wallet struct {
 	PrivateKey ecdsa.PrivateKey
 	PublicKey  []byte
 }
 
-func (w Wallet) Address() []byte {
+// Address is the address of the wallet on a network, its first byte is the
+// address version of the network.
+func (w Wallet) Address(params *chaincfg.Params) []byte {
 	// get address of a wallet
 	var address []byte
 
 	pubKeyHash := PublicKeyHash(w.PublicKey)
-	versionHash := append([]byte{version}, pubKeyHash...) // version payload
+	versionHash := append([]byte{params.AddressVersion}, pubKeyHash...) // version payload
 
 	checksum := Checksum(versionHash)
 
@@ -39,34 +41,35 @@ func (w Wallet) Address() []byte {
 func PublicKeyHash(pubKey []byte) []byte {
 	sha := sha256.Sum256(pubKey)
 
+	// writing to a hash.Hash never fails
 	ripemdHasher := ripemd160.New()
-	_, err := ripemdHasher.Write(sha[:])
-	if err != nil {
-		log.Panic(err)
-	}
+	ripemdHasher.Write(sha[:])
 	ripemd160 := ripemdHasher.Sum(nil) // payload
 
 	return ripemd160
 }
 
-func NewKeyPair() (ecdsa.PrivateKey, []byte) {
+func NewKeyPair() (ecdsa.PrivateKey, []byte, error) {
 	// generate new ECDSA key pair
 	curve := elliptic.P256()
 
 	privKey, err := ecdsa.GenerateKey(curve, rand.Reader)
 	if err != nil {
-		log.Panic(err)
+		return ecdsa.PrivateKey{}, nil, err
 	}
 
 	pubKey := append(privKey.PublicKey.X.Bytes(), privKey.PublicKey.Y.Bytes()...)
 
-	return *privKey, pubKey
+	return *privKey, pubKey, nil
 }
 
-func MakeWallet() *Wallet {
+func MakeWallet() (*Wallet, error) {
 	// create a new wallet
-	priv, pub := NewKeyPair()
-	return &Wallet{priv, pub}
+	priv, pub, err := NewKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	return &Wallet{priv, pub}, nil
 }
 
 func Checksum(payload []byte) []byte {
@@ -77,11 +80,19 @@ func Checksum(payload []byte) []byte {
 	return second[:ChecksumLength]
 }
 
-func ValidateAddress(address []byte) bool {
-	pubKeyHash := Base58Decode(address)
+// ValidateAddress checks the checksum of an address and that it belongs to
+// the network of params.
+func ValidateAddress(address []byte, params *chaincfg.Params) bool {
+	pubKeyHash, err := Base58Decode(address)
+	if err != nil || len(pubKeyHash) <= 1+ChecksumLength {
+		return false
+	}
 	actualChecksum := pubKeyHash[len(pubKeyHash)-ChecksumLength:]
 
 	version := pubKeyHash[0]
+	if version != params.AddressVersion {
+		return false
+	}
 	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-ChecksumLength]
 	targetChecksum := Checksum(append([]byte{version}, pubKeyHash...))
 
@@ -4,20 +4,28 @@ import (
 	"bytes"
 	"crypto/elliptic"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
+
+	"github.com/phnaharris/harris-blockchain-token/chaincfg"
 )
 
-const walletFile = "./tmp/wallets_%s.data"
+const walletFile = "%s/wallets_%s.data"
+
+var ErrUnknownWallet = errors.New("wallet is not in the wallet file")
 
+// Wallets are the wallets of a node on one network, by address.
 type Wallets struct {
 	Wallets map[string]*Wallet
+
+	params *chaincfg.Params
 }
 
-func CreateWallets(nodeId string) (*Wallets, error) {
+func CreateWallets(nodeId string, params *chaincfg.Params) (*Wallets, error) {
 	// load list of wallet from file
-	ws := Wallets{}
+	ws := Wallets{params: params}
 	ws.Wallets = make(map[string]*Wallet)
 
 	err := ws.LoadFile(nodeId)
@@ -25,12 +33,15 @@ func CreateWallets(nodeId string) (*Wallets, error) {
 	return &ws, err
 }
 
-func (ws *Wallets) AddWallet() string {
+func (ws *Wallets) AddWallet() (string, error) {
 	// add wallet to list and return address
-	wallet := MakeWallet()
-	address := wallet.Address()
+	wallet, err := MakeWallet()
+	if err != nil {
+		return "", err
+	}
+	address := wallet.Address(ws.params)
 	ws.Wallets[string(address)] = wallet
-	return string(address)
+	return string(address), nil
 }
 
 func (ws *Wallets) GetAllAddresses() []string {
@@ -42,13 +53,17 @@ func (ws *Wallets) GetAllAddresses() []string {
 	return addresses
 }
 
-func (ws *Wallets) GetWallet(address string) Wallet {
-	return *ws.Wallets[address]
+func (ws *Wallets) GetWallet(address string) (Wallet, error) {
+	wallet, ok := ws.Wallets[address]
+	if !ok {
+		return Wallet{}, fmt.Errorf("%w: %s", ErrUnknownWallet, address)
+	}
+	return *wallet, nil
 }
 
 func (ws *Wallets) LoadFile(nodeId string) error {
 	// check if file is exist
-	walletFile := fmt.Sprintf(walletFile, nodeId)
+	walletFile := fmt.Sprintf(walletFile, ws.params.DataDir, nodeId)
 	if _, err := os.Stat(walletFile); os.IsNotExist(err) {
 		return err
 	}
@@ -74,7 +89,7 @@ func (ws *Wallets) LoadFile(nodeId string) error {
 
 func (ws *Wallets) SaveFile(nodeId string) error {
 	var content bytes.Buffer
-	walletFile := fmt.Sprintf(walletFile, nodeId)
+	walletFile := fmt.Sprintf(walletFile, ws.params.DataDir, nodeId)
 
 	gob.Register(elliptic.P256())
 
@@ -84,6 +99,11 @@ func (ws *Wallets) SaveFile(nodeId string) error {
 		return err
 	}
 
+	err = os.MkdirAll(ws.params.DataDir, 0755)
+	if err != nil {
+		return err
+	}
+
 	err = ioutil.WriteFile(walletFile, content.Bytes(), 0644)
 	if err != nil {
 		return err